@@ -0,0 +1,269 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type Permission identifies the operations an HTTP client may be allowed to
+// perform. Permissions can be combined as a bitmask.
+type Permission int
+
+const (
+	PermRead  Permission = 1 << iota // List tasks and retrieve their history
+	PermWrite                        // Request cancellation of tasks
+
+	PermAll = PermRead | PermWrite
+)
+
+const (
+	HeaderAuthorization = "Authorization"
+	HeaderTimestamp     = "X-Pm-Timestamp"
+
+	authBearer = "Bearer "
+	authHMAC   = "PM-HMAC-SHA256 "
+)
+
+// MaxSignedBody is the maximum size, in bytes, for the body of HMAC-signed
+// requests. Larger bodies are rejected without being read in full, given that
+// they're read before the signature can be verified.
+const MaxSignedBody = 1 << 20
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// Type Authorizer is implemented by the objects deciding whether an HTTP
+// request may proceed. Authorize should return nil to grant access,
+// ErrUnauthorized if the client failed to authenticate, or ErrForbidden if the
+// client is known but lacks the required permission. Any other error is
+// handled like ErrUnauthorized.
+type Authorizer interface {
+	Authorize(r *http.Request, perm Permission) error
+}
+
+// Type AuthorizerFunc is an adapter to use ordinary functions as Authorizers.
+type AuthorizerFunc func(r *http.Request, perm Permission) error
+
+// Authorize calls f(r, perm).
+func (f AuthorizerFunc) Authorize(r *http.Request, perm Permission) error {
+	return f(r, perm)
+}
+
+// Type TokenAuthorizer authorizes requests carrying a static bearer token in
+// the Authorization header. The map holds the permissions for each token.
+type TokenAuthorizer map[string]Permission
+
+// Authorize checks the bearer token in the request against the known set.
+func (a TokenAuthorizer) Authorize(r *http.Request, perm Permission) error {
+	auth := r.Header.Get(HeaderAuthorization)
+	if !strings.HasPrefix(auth, authBearer) {
+		return ErrUnauthorized
+	}
+	token := []byte(strings.TrimPrefix(auth, authBearer))
+
+	// Compare against every token in constant time, so that valid tokens
+	// can't be guessed by timing requests
+	for known, granted := range a {
+		if subtle.ConstantTimeCompare(token, []byte(known)) == 1 {
+			if granted&perm != perm {
+				return ErrForbidden
+			}
+			return nil
+		}
+	}
+	return ErrUnauthorized
+}
+
+// Type HMACAuthorizer authorizes requests signed with a shared secret key, as
+// done by SignRequest(). Requests whose timestamp differs from the server clock
+// by more than MaxSkew are rejected, to limit replays. MaxSkew defaults to five
+// minutes if not set.
+type HMACAuthorizer struct {
+	Key     []byte
+	Perms   Permission
+	MaxSkew time.Duration
+}
+
+// Authorize verifies the request signature and timestamp.
+func (a *HMACAuthorizer) Authorize(r *http.Request, perm Permission) error {
+	auth := r.Header.Get(HeaderAuthorization)
+	if !strings.HasPrefix(auth, authHMAC) {
+		return ErrUnauthorized
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(auth, authHMAC))
+	if err != nil {
+		return ErrUnauthorized
+	}
+
+	timestamp := r.Header.Get(HeaderTimestamp)
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrUnauthorized
+	}
+	maxSkew := a.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = 5 * time.Minute
+	}
+	skew := time.Since(time.Unix(secs, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return ErrUnauthorized
+	}
+
+	expected, err := requestMAC(r, a.Key, timestamp)
+	if err != nil || !hmac.Equal(signature, expected) {
+		return ErrUnauthorized
+	}
+	if a.Perms&perm != perm {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// SignRequest signs an HTTP request with the given key, as expected by an
+// HMACAuthorizer at the server. The request body, if any, is read and replaced
+// so that it can still be sent. Bodies beyond MaxSignedBody bytes fail with
+// ErrBodyTooLarge.
+func SignRequest(r *http.Request, key []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac, err := requestMAC(r, key, timestamp)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(HeaderTimestamp, timestamp)
+	r.Header.Set(HeaderAuthorization, authHMAC+hex.EncodeToString(mac))
+	return nil
+}
+
+// requestMAC computes the signature for a request, covering the method, URI,
+// timestamp and a digest of the body. The body is replaced after reading, and
+// fails with ErrBodyTooLarge beyond MaxSignedBody bytes. The URI for incoming
+// requests is taken as received, given that a prefix may have been stripped
+// from the URL (see Handler()).
+func requestMAC(r *http.Request, key []byte, timestamp string) ([]byte, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(io.LimitReader(r.Body, MaxSignedBody+1)); err != nil {
+			return nil, err
+		}
+		if len(body) > MaxSignedBody {
+			return nil, ErrBodyTooLarge
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	digest := sha256.Sum256(body)
+
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, r.Method+"\n"+uri+"\n"+timestamp+"\n")
+	io.WriteString(mac, hex.EncodeToString(digest[:]))
+	return mac.Sum(nil), nil
+}
+
+// SetAuthorizer sets the Authorizer used to check requests to the HTTP
+// interface for this Proclist. A nil Authorizer (the default) lets every client
+// in.
+func (pl *Proclist) SetAuthorizer(a Authorizer) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.auth = a
+}
+
+// authorizer returns the Authorizer currently set for the Proclist.
+func (pl *Proclist) authorizer() Authorizer {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	return pl.auth
+}
+
+// authorize checks an HTTP request, replying with the proper error if denied.
+// Refused cancellation requests are recorded for the task with the given
+// identifier (empty for requests not targeting a single task).
+func (pl *Proclist) authorize(w http.ResponseWriter, r *http.Request, perm Permission, id string) bool {
+	a := pl.authorizer()
+	if a == nil {
+		return true
+	}
+	err := a.Authorize(r, perm)
+	if err == nil {
+		return true
+	}
+
+	httpCode := http.StatusUnauthorized
+	if err == ErrForbidden {
+		httpCode = http.StatusForbidden
+	}
+	if perm&PermWrite != 0 && (r.Method == "DELETE" || id == "") {
+		pl.denyCancel(id, r.RemoteAddr, http.StatusText(httpCode))
+	}
+	httpError(w, httpCode)
+	return false
+}
+
+// denyCancel records a refused cancellation request. The first denial for a
+// running task is added to its history, as a marker, besides being reported as
+// an event (and thus journaled). Further ones only update the marker with their
+// count, so that unauthenticated clients can't grow either without bounds.
+// Denials for other identifiers only yield the event, at most once a second.
+func (pl *Proclist) denyCancel(id, remoteAddr, reason string) {
+	ts := time.Now()
+	hentry := "[cancel request denied: " + reason + "]"
+	attrs := map[string]interface{}{"remoteAddr": remoteAddr}
+
+	if p, present := pl.lookup(id); present && id != "" {
+		var ev *Event
+		p.mu.Lock()
+		if p.ended.IsZero() {
+			if p.denials++; p.denials == 1 {
+				p.addHistoryMarker(ts, hentry)
+				p.denied = p.history.Back().Value.(*historyEntry)
+				ev = p.newEvent(EventCancelDenied, ts, hentry, attrs)
+			} else {
+				p.denied.status = fmt.Sprintf("[cancel request denied: %s (%d times)]",
+					reason, p.denials)
+			}
+		}
+		p.mu.Unlock()
+		pl.send(ev)
+		return
+	}
+	last := pl.denied.Load()
+	if ts.UnixNano()-last < int64(time.Second) || !pl.denied.CompareAndSwap(last, ts.UnixNano()) {
+		return
+	}
+	if pl.subscribed() {
+		pl.emit(Event{
+			Type:   EventCancelDenied,
+			Id:     id,
+			Ts:     ts,
+			Status: hentry,
+			Attrs:  attrs,
+		})
+	}
+}
+
+// SetAuthorizer sets the Authorizer used to check requests to the HTTP
+// interface for the default Proclist. A nil Authorizer (the default) lets every
+// client in.
+func SetAuthorizer(a Authorizer) {
+	DefaultProclist.SetAuthorizer(a)
+}
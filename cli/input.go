@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
 )
 
 func inputLoop() {
@@ -20,9 +19,7 @@ func inputLoop() {
 			id = readString("ID: ")
 			message = readString("Message: ")
 			fmt.Printf("Killing ID %s on %s with message %s.\n", id, host, message)
-			if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
-				host = "http://" + host
-			}
+			host = withScheme(host)
 
 			client, exists := clients[host]
 			if exists {
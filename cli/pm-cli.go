@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +17,13 @@ import (
 
 var (
 	Endpoints       = "" // e.g. "api1:9085,api2:9085,api1:9086,api2:9086"
+	Token           = ""
+	HMACKey         = ""
+	CAFile          = ""
+	CertFile        = ""
+	KeyFile         = ""
+	SortBy          = "age"
+	Query           = pm.ProcQuery{}
 	KeepHist        = true
 	RefreshInterval = time.Second
 	clients         = map[string]*client.Client{}
@@ -34,11 +44,25 @@ var (
 	}
 
 	paused = false
+
+	// Scheme for endpoints given without one
+	DefaultScheme = "http://"
+
+	// Sort order for APIs matching each -sort flag, for pagination
+	QuerySortFor = map[string]string{
+		"age":        "procTime",
+		"status-age": "statusTime",
+		"id":         "id",
+		"progress":   "-progress",
+		"eta":        "eta",
+	}
 )
 
 type Line struct {
 	Host, Id, Status   string
 	ProcAge, StatusAge time.Duration
+	Percent            float64       // -1 if no progress was reported
+	ETA                time.Duration // Time left; -1 if unknown
 	Cols               map[string]string
 }
 
@@ -48,19 +72,72 @@ func init() {
 }
 
 func main() {
-	flag.StringVar(&Endpoints, "endpoints", Endpoints, "Comma-separated host:port list of APIs to poll")
+	flag.StringVar(&Endpoints, "endpoints", Endpoints, "Comma-separated list of APIs to poll (host:port, or unix:///path for sockets)")
 	flag.BoolVar(&KeepHist, "keep-hist", KeepHist, "Keep output history on refreshes")
 	flag.DurationVar(&RefreshInterval, "refresh", RefreshInterval, "Time interval between refreshes")
+	flag.StringVar(&Token, "token", Token, "Bearer token to authenticate with the APIs")
+	flag.StringVar(&HMACKey, "hmac-key", HMACKey, "Shared key to sign requests to the APIs")
+	flag.StringVar(&CAFile, "ca", CAFile, "CA bundle to verify the APIs' certificates (implies https)")
+	flag.StringVar(&CertFile, "cert", CertFile, "Client certificate for mutual TLS (implies https)")
+	flag.StringVar(&KeyFile, "key", KeyFile, "Private key for the client certificate")
+	statusFilter := flag.String("status", "", "Comma-separated list of statuses to show")
+	attrFilter := flag.String("attr", "", "Comma-separated name=value list of attributes to match")
+	attrPrefixFilter := flag.String("attr-prefix", "", "Comma-separated name=prefix list of attributes to match")
+	flag.DurationVar(&Query.MinAge, "min-age", 0, "Show only tasks running for at least this long")
+	cancellingFilter := flag.String("cancelling", "", "Show only tasks with (true) or without (false) a cancellation pending")
+	flag.IntVar(&Query.Limit, "limit", 0, "Max number of tasks (the first ones as per -sort) to show per API")
+	flag.IntVar(&Query.Offset, "offset", 0, "Number of tasks (as per -sort) to skip per API")
+	flag.StringVar(&SortBy, "sort", SortBy, "Sort tasks by age, status-age, id, progress or eta")
 	flag.Parse()
 
+	querySort, ok := QuerySortFor[SortBy]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "bad sort order:", SortBy)
+		os.Exit(1)
+	}
+	if *cancellingFilter != "" {
+		cancelling, err := strconv.ParseBool(*cancellingFilter)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "bad cancelling filter:", *cancellingFilter)
+			os.Exit(1)
+		}
+		Query.Cancelling = &cancelling
+	}
+
+	if *statusFilter != "" {
+		Query.Status = strings.Split(*statusFilter, ",")
+	}
+	Query.Attrs = parseAttrs(*attrFilter)
+	Query.AttrPrefix = parseAttrs(*attrPrefixFilter)
+	if Query.Limit > 0 || Query.Offset > 0 {
+		// Have APIs pick tasks in the same order they're shown
+		Query.Sort = querySort
+	}
+
+	var tlsConfig *tls.Config
+	if CAFile != "" || CertFile != "" || KeyFile != "" {
+		var err error
+		if tlsConfig, err = client.LoadTLSConfig(CAFile, CertFile, KeyFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		DefaultScheme = "https://"
+	}
+
 	ticker := multitick.NewTicker(RefreshInterval, RefreshInterval)
 
 	endpoints := strings.Split(Endpoints, ",")
 	for _, e := range endpoints {
-		if !strings.HasPrefix(e, "http://") && !strings.HasPrefix(e, "https://") {
-			e = "http://" + e
+		e = withScheme(e)
+		if tlsConfig != nil {
+			clients[e] = client.NewTLSClient(e, tlsConfig)
+		} else {
+			clients[e] = client.NewClient(e)
+		}
+		clients[e].Token = Token
+		if HMACKey != "" {
+			clients[e].HMACKey = []byte(HMACKey)
 		}
-		clients[e] = client.NewClient(e)
 
 		go poll(e, ticker.Subscribe())
 	}
@@ -107,10 +184,33 @@ func main() {
 	}
 }
 
+// withScheme prepends the default scheme to an endpoint lacking one.
+func withScheme(endpoint string) string {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") &&
+		!strings.HasPrefix(endpoint, client.UnixScheme) {
+		return DefaultScheme + endpoint
+	}
+	return endpoint
+}
+
+// parseAttrs parses a comma-separated list of name=value pairs.
+func parseAttrs(list string) map[string]string {
+	if list == "" {
+		return nil
+	}
+	attrs := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		if sep := strings.Index(pair, "="); sep > 0 {
+			attrs[pair[:sep]] = pair[sep+1:]
+		}
+	}
+	return attrs
+}
+
 // poll one of the endpoints for its /procs/ data.
 func poll(hostPort string, ticker <-chan time.Time) {
 	for _ = range ticker {
-		msg, err := clients[hostPort].Processes()
+		msg, err := clients[hostPort].QueryProcesses(&Query)
 		if err == nil {
 			msgToLines(hostPort, msg)
 		}
@@ -120,11 +220,13 @@ func poll(hostPort string, ticker <-chan time.Time) {
 func msgToLines(hostPort string, msg *pm.ProcResponse) {
 	for _, p := range msg.Procs {
 		l := Line{
-			Host:      strings.Replace(hostPort, "http://", "", -1),
+			Host:      strings.TrimPrefix(strings.TrimPrefix(hostPort, "http://"), "https://"),
 			Id:        p.Id,
 			Status:    p.Status,
 			ProcAge:   msg.ServerTime.Sub(p.ProcTime),
 			StatusAge: msg.ServerTime.Sub(p.StatusTime),
+			Percent:   -1,
+			ETA:       -1,
 			Cols:      map[string]string{},
 		}
 		for name, value := range p.Attrs {
@@ -137,6 +239,9 @@ func msgToLines(hostPort string, msg *pm.ProcResponse) {
 			}
 			l.Cols[name] = value.(string)
 		}
+		if p.Progress != nil {
+			setProgress(&l, p.Progress, msg.ServerTime)
+		}
 		Trickle <- l
 	}
 }
@@ -149,13 +254,69 @@ func top(ticker <-chan time.Time) {
 		case l := <-Trickle:
 			Lines = append(Lines, l)
 		case <-ticker:
-			sort.Sort(ByAge(Lines))
+			sortLines(Lines)
 			Display <- Lines
 			Lines = Lines[0:0]
 		}
 	}
 }
 
+// setProgress fills in the progress for a line, adding a column to show it.
+func setProgress(l *Line, pr *pm.ProgressDetail, now time.Time) {
+	var col string
+	if pr.Total > 0 {
+		l.Percent = pr.Percent
+		col = fmt.Sprintf("%.1f%%", pr.Percent)
+	} else {
+		col = fmt.Sprintf("%d", pr.Done)
+	}
+	if pr.Unit != "" {
+		col += " " + pr.Unit
+	}
+	if pr.ETA != nil {
+		l.ETA = pr.ETA.Sub(now)
+		if l.ETA < 0 {
+			l.ETA = 0
+		}
+		col += " eta " + l.ETA.Round(time.Second).String()
+	}
+
+	const name = "progress"
+	if _, ok := LengthFor[name]; !ok {
+		Columns = append(Columns, name)
+		LengthFor[name] = len(name)
+	}
+	if len(col) > LengthFor[name] {
+		LengthFor[name] = len(col)
+	}
+	l.Cols[name] = col
+}
+
+// sortLines sorts lines as per the -sort flag: oldest tasks, oldest statuses,
+// identifiers in order, most advanced tasks or those closest to completion
+// first.
+func sortLines(lines []Line) {
+	switch SortBy {
+	case "status-age":
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].StatusAge > lines[j].StatusAge })
+	case "id":
+		sort.SliceStable(lines, func(i, j int) bool {
+			if lines[i].Id != lines[j].Id {
+				return lines[i].Id < lines[j].Id
+			}
+			return lines[i].Host < lines[j].Host
+		})
+	case "progress":
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].Percent > lines[j].Percent })
+	case "eta":
+		sort.SliceStable(lines, func(i, j int) bool {
+			return lines[i].ETA >= 0 && (lines[j].ETA < 0 || lines[i].ETA < lines[j].ETA)
+		})
+	default:
+		sort.Sort(ByAge(lines))
+	}
+}
+
 // ByAge implements sort.Interface for []line based on
 // the ProcAge field.
 type ByAge []Line
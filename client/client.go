@@ -6,24 +6,40 @@ This package provides an HTTP client to use with pm-enabled processes.
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/VividCortex/pm"
 )
 
+// Type Client connects to the HTTP interface of a pm-enabled process. Requests
+// carry Token as a bearer token if set, and are signed with HMACKey if set,
+// as required by the authorizer configured at the server.
 type Client struct {
 	*http.Client
 	BaseURI string
 	Headers map[string]string
+	Token   string
+	HMACKey []byte
 }
 
-// NewClient returns a new client set to connect to the given URI.
+// UnixScheme is the URI scheme for endpoints listening on Unix domain sockets,
+// followed by the socket path (e.g., "unix:///run/app/pm.sock").
+const UnixScheme = "unix://"
+
+// NewClient returns a new client set to connect to the given URI. URIs with
+// the UnixScheme connect to the Unix domain socket at the given path.
 func NewClient(uri string) *Client {
-	return &Client{
+	c := &Client{
 		Client:  &http.Client{},
 		BaseURI: uri,
 		Headers: map[string]string{
@@ -32,6 +48,69 @@ func NewClient(uri string) *Client {
 			"User-Agent":   "go-pm",
 		},
 	}
+	if strings.HasPrefix(uri, UnixScheme) {
+		path := strings.TrimPrefix(uri, UnixScheme)
+		c.Client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		c.BaseURI = "http://unix"
+	}
+	return c
+}
+
+// NewTLSClient returns a new client set to connect to the given URI with the
+// given TLS configuration, as returned by LoadTLSConfig() for instance. URIs
+// with the UnixScheme speak TLS over the Unix domain socket; note that the
+// configuration should set ServerName then.
+func NewTLSClient(uri string, config *tls.Config) *Client {
+	c := NewClient(uri)
+	if t, ok := c.Client.Transport.(*http.Transport); ok {
+		t.TLSClientConfig = config
+		c.BaseURI = "https://unix"
+	} else {
+		c.Client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+	return c
+}
+
+// LoadTLSConfig builds a TLS configuration from PEM-encoded files. If caFile is
+// not empty, the server certificate is verified against the authorities in it
+// instead of the system's. If certFile and keyFile are not empty, the client
+// presents that certificate to the server (mutual TLS).
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pool, err := pm.LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// prepare sets the headers for a request, including authentication data.
+func (c *Client) prepare(req *http.Request) error {
+	for header, value := range c.Headers {
+		req.Header.Add(header, value)
+	}
+	if c.Token != "" {
+		req.Header.Set(pm.HeaderAuthorization, "Bearer "+c.Token)
+	}
+	if c.HMACKey != nil {
+		return pm.SignRequest(req, c.HMACKey)
+	}
+	return nil
 }
 
 func (c *Client) makeRequest(verb, endpoint string, body, result interface{}) error {
@@ -45,8 +124,8 @@ func (c *Client) makeRequest(verb, endpoint string, body, result interface{}) er
 	if err != nil {
 		return err
 	}
-	for header, value := range c.Headers {
-		req.Header.Add(header, value)
+	if err := c.prepare(req); err != nil {
+		return err
 	}
 
 	resp, err := c.Do(req)
@@ -74,6 +153,32 @@ func (c *Client) Processes() (*pm.ProcResponse, error) {
 	return &result, nil
 }
 
+// QueryProcesses issues a GET to /proc with the given query, thus retrieving
+// the tasks from the server that match a filter, sorted and paginated as
+// requested.
+func (c *Client) QueryProcesses(q *pm.ProcQuery) (*pm.ProcResponse, error) {
+	var result pm.ProcResponse
+	endpoint := "/procs/"
+	if params := q.Values().Encode(); params != "" {
+		endpoint += "?" + params
+	}
+
+	if err := c.makeRequest("GET", endpoint, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DoneProcesses issues a GET to /procs/done, thus retrieving the list of
+// recently finished tasks retained by the server, most recent first.
+func (c *Client) DoneProcesses() (*pm.ProcResponse, error) {
+	var result pm.ProcResponse
+	if err := c.makeRequest("GET", "/procs/done", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 // History issues a GET to /proc/<id>/history for a given id, thus returning the
 // complete history for the task <id> at the server.
 func (c *Client) History(id string) (*pm.HistoryResponse, error) {
@@ -86,6 +191,18 @@ func (c *Client) History(id string) (*pm.HistoryResponse, error) {
 	return &result, nil
 }
 
+// Children issues a GET to /procs/<id>/children for a given id, thus returning
+// all tasks descending from <id> at the server.
+func (c *Client) Children(id string) (*pm.ProcResponse, error) {
+	var result pm.ProcResponse
+	endpoint := fmt.Sprintf("/procs/%s/children", id)
+
+	if err := c.makeRequest("GET", endpoint, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 // Kill requests the cancellation of a given task. Note that it will effectively
 // be cancelled as soon as the task reaches its next cancellation point.
 func (c *Client) Kill(id, message string) error {
@@ -97,3 +214,119 @@ func (c *Client) Kill(id, message string) error {
 	}
 	return nil
 }
+
+// KillMatching issues a POST to /procs/kill, thus requesting the cancellation
+// of all tasks matching the filter. The server refuses empty filters.
+func (c *Client) KillMatching(filter pm.ProcFilter, message string) (*pm.KillResponse, error) {
+	var result pm.KillResponse
+	body := pm.KillRequest{Filter: filter, Message: message}
+
+	if err := c.makeRequest("POST", "/procs/kill", body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Drain issues a POST to /procs/drain, thus making the server reject new tasks
+// and wait for running ones to finish. Tasks still running after the grace
+// period get a cancellation request; grace must be positive. Drain returns as
+// soon as the server starts draining; DrainStatus() reports progress.
+func (c *Client) Drain(grace time.Duration) error {
+	body := pm.DrainRequest{Grace: grace}
+	return c.makeRequest("POST", "/procs/drain", body, nil)
+}
+
+// DrainStatus issues a GET to /procs/drain, thus retrieving the drain state at
+// the server, including the report once draining completes.
+func (c *Client) DrainStatus() (*pm.DrainStatus, error) {
+	var result pm.DrainStatus
+	if err := c.makeRequest("GET", "/procs/drain", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// KillGeneration works like Kill(), but the request is refused unless gen
+// matches the generation number of the task running with the given id. This
+// prevents killing a different task that happened to reuse the identifier.
+func (c *Client) KillGeneration(id string, gen uint64, message string) error {
+	body := pm.CancelRequest{Message: message, Generation: gen}
+	endpoint := fmt.Sprintf("/procs/%s", id)
+
+	return c.makeRequest("DELETE", endpoint, body, nil)
+}
+
+// Events issues a GET to /procs/events, thus subscribing to the stream of task
+// lifecycle events from the server. Events are delivered through the returned
+// channel, which is closed when the stream ends or ctx is done.
+func (c *Client) Events(ctx context.Context) (<-chan pm.Event, error) {
+	return stream[pm.Event](ctx, c, "/procs/events")
+}
+
+// Log issues a GET to /procs/<id>/log for a given id, thus returning the lines
+// currently in the log for the task.
+func (c *Client) Log(id string) (*pm.LogResponse, error) {
+	var result pm.LogResponse
+	endpoint := fmt.Sprintf("/procs/%s/log", id)
+
+	if err := c.makeRequest("GET", endpoint, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// FollowLog issues a GET to /procs/<id>/log?follow=true for a given id, thus
+// streaming the lines in the log for the task, as well as those added later.
+// Lines are delivered through the returned channel, which is closed when the
+// task ends or ctx is done.
+func (c *Client) FollowLog(ctx context.Context, id string) (<-chan pm.LogLine, error) {
+	return stream[pm.LogLine](ctx, c, fmt.Sprintf("/procs/%s/log?follow=true", id))
+}
+
+// stream issues a GET to a Server-Sent Events endpoint, delivering the data of
+// each event (decoded as JSON) through the returned channel. The channel is
+// closed when the stream ends or ctx is done.
+func stream[T any](ctx context.Context, c *Client, endpoint string) (<-chan T, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURI+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.prepare(req); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", pm.MediaEventStream)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode > 299 {
+		resp.Body.Close()
+		msg := fmt.Sprintf("HTTP Status Code %d from GET %s\n", resp.StatusCode, c.BaseURI+endpoint)
+		return nil, errors.New(msg)
+	}
+
+	events := make(chan T)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			var ev T
+			if err := json.Unmarshal([]byte(strings.TrimSpace(line[len("data:"):])), &ev); err != nil {
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
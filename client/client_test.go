@@ -0,0 +1,61 @@
+package client
+
+// Copyright (c) 2013 VividCortex. Please see the LICENSE file for license terms.
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/pm"
+)
+
+func TestListenAndServeUnix(t *testing.T) {
+	dir := t.TempDir()
+	var pl pm.Proclist
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+
+	path := filepath.Join(dir, "pm.sock")
+	go pl.ListenAndServeUnix(path, 0600)
+	c := NewClient(UnixScheme + path)
+	var procs *pm.ProcResponse
+	for i := 0; ; i++ {
+		var err error
+		if procs, err = c.Processes(); err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(procs.Procs) != 1 || procs.Procs[0].Id != "req1" {
+		t.Errorf("bad process list: %+v", procs)
+	}
+
+	// TLS over a Unix domain socket must keep dialing the socket
+	tlsPath := filepath.Join(dir, "pm-tls.sock")
+	l, err := net.Listen("unix", tlsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(pl.Handler("/"))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.StartTLS()
+	defer srv.Close()
+
+	config := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.ServerName = "example.com"
+	c = NewTLSClient(UnixScheme+tlsPath, config)
+	if procs, err = c.Processes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(procs.Procs) != 1 || procs.Procs[0].Id != "req1" {
+		t.Errorf("bad process list: %+v", procs)
+	}
+}
@@ -0,0 +1,68 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"time"
+)
+
+// retain adds a finished process to the list of done tasks, if the options for
+// the Proclist say so. Older entries are discarded as needed to comply with
+// the DoneMaxCount and DoneMaxAge options. Retention is enabled when any of
+// them is set; a zero value means no limit for that option.
+func (pl *Proclist) retain(p *proc) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pl.opts.DoneMaxCount <= 0 && pl.opts.DoneMaxAge <= 0 {
+		return
+	}
+	pl.doneList.PushFront(p)
+	pl.pruneDone(time.Now())
+}
+
+// pruneDone discards finished processes exceeding the limits set for the
+// Proclist, assuming the lock is already held. The most recently finished
+// process is kept at the front of the list.
+func (pl *Proclist) pruneDone(now time.Time) {
+	maxCount, maxAge := pl.opts.DoneMaxCount, pl.opts.DoneMaxAge
+	if maxCount <= 0 && maxAge <= 0 {
+		pl.doneList.Init()
+		return
+	}
+
+	for entry := pl.doneList.Back(); entry != nil; entry = pl.doneList.Back() {
+		p := entry.Value.(*proc)
+		if (maxCount > 0 && pl.doneList.Len() > maxCount) ||
+			(maxAge > 0 && now.Sub(p.ended) > maxAge) {
+			pl.doneList.Remove(entry)
+		} else {
+			break
+		}
+	}
+}
+
+// doneProcs returns the list of retained finished processes, most recent first.
+func (pl *Proclist) doneProcs() []*proc {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.pruneDone(time.Now())
+
+	procs := make([]*proc, 0, pl.doneList.Len())
+	for entry := pl.doneList.Front(); entry != nil; entry = entry.Next() {
+		procs = append(procs, entry.Value.(*proc))
+	}
+	return procs
+}
+
+// findDone returns the most recently finished process with the given id, if
+// still retained.
+func (pl *Proclist) findDone(id string) (*proc, bool) {
+	for _, p := range pl.doneProcs() {
+		if p.id == id {
+			return p, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,154 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DrainGraceExpired is the cancellation message for tasks still running when
+// the grace period for Drain() expires.
+const DrainGraceExpired = "drain grace period expired"
+
+type drainState struct {
+	draining bool
+	drained  chan struct{} // Closed as soon as no tasks remain
+	report   *DrainReport  // Set when the last drain completed
+}
+
+// checkDrained signals a drain in progress if no tasks remain, assuming the
+// lock is already held.
+func (pl *Proclist) checkDrained() {
+	if !pl.drain.draining || len(pl.procs) > 0 {
+		return
+	}
+	select {
+	case <-pl.drain.drained:
+	default:
+		close(pl.drain.drained)
+	}
+}
+
+// Drain makes the Proclist reject new tasks and waits for the running ones to
+// finish. If ctx is done before that, a cancellation request is issued for the
+// remaining tasks, and Drain returns without waiting any further. The report
+// lists the tasks that ended while draining, and those that were killed or
+// refused cancellation because of the ForbidCancel option. The Proclist keeps
+// rejecting new tasks after Drain returns.
+func (pl *Proclist) Drain(ctx context.Context) DrainReport {
+	pl.mu.Lock()
+	if !pl.drain.draining {
+		pl.drain.draining = true
+		pl.drain.drained = make(chan struct{})
+	}
+	pl.drain.report = nil
+	running := make([]*proc, 0, len(pl.procs))
+	for _, p := range pl.procs {
+		running = append(running, p)
+	}
+	pl.checkDrained()
+	drained := pl.drain.drained
+	pl.mu.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+
+	ts := time.Now()
+	report := DrainReport{Ended: []string{}, Killed: []string{}, Forbidden: []string{}}
+	for _, p := range running {
+		pl.mu.RLock()
+		present := pl.procs[p.id] == p
+		pl.mu.RUnlock()
+
+		if !present {
+			report.Ended = append(report.Ended, p.id)
+		} else if err := pl.kill(p, ts, DrainGraceExpired); err == ErrForbidden {
+			report.Forbidden = append(report.Forbidden, p.id)
+		} else {
+			report.Killed = append(report.Killed, p.id)
+		}
+	}
+	sort.Strings(report.Ended)
+	sort.Strings(report.Killed)
+	sort.Strings(report.Forbidden)
+
+	pl.mu.Lock()
+	pl.drain.report = &report
+	pl.mu.Unlock()
+	return report
+}
+
+// Draining returns whether the Proclist is being (or has been) drained.
+func (pl *Proclist) Draining() bool {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	return pl.drain.draining
+}
+
+func (pl *Proclist) handleDrainReq(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var drain DrainRequest
+		if err := json.NewDecoder(r.Body).Decode(&drain); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if drain.Grace <= 0 {
+			http.Error(w, "grace period must be positive", http.StatusBadRequest)
+			return
+		}
+		// Make sure the list is draining before replying
+		pl.mu.Lock()
+		if !pl.drain.draining {
+			pl.drain.draining = true
+			pl.drain.drained = make(chan struct{})
+			pl.checkDrained()
+		}
+		pl.mu.Unlock()
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), drain.Grace)
+			defer cancel()
+			pl.Drain(ctx)
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	pl.mu.RLock()
+	status := DrainStatus{
+		Draining:   pl.drain.draining,
+		Running:    len(pl.procs),
+		Report:     pl.drain.report,
+		ServerTime: time.Now(),
+	}
+	pl.mu.RUnlock()
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(HeaderContentType, MediaJSON)
+	w.Write(b)
+}
+
+// Drain makes the default Proclist reject new tasks and waits for the running
+// ones to finish. If ctx is done before that, a cancellation request is issued
+// for the remaining tasks, and Drain returns without waiting any further. The
+// report lists the tasks that ended while draining, and those that were killed
+// or refused cancellation because of the ForbidCancel option.
+func Drain(ctx context.Context) DrainReport {
+	return DefaultProclist.Drain(ctx)
+}
+
+// Draining returns whether the default Proclist is being (or has been) drained.
+func Draining() bool {
+	return DefaultProclist.Draining()
+}
@@ -0,0 +1,129 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventBufferSize is the number of events buffered for each subscriber. Events
+// are dropped for subscribers falling behind, so that tasks never block.
+const eventBufferSize = 1024
+
+type subscribers struct {
+	mu      sync.Mutex
+	chans   map[chan Event]struct{}
+	journal *Journal
+	hooks   []*hooksEntry
+
+	// Number of receivers of events above, for a lock-free check
+	count atomic.Int32
+}
+
+// updateCount refreshes the number of receivers of events, assuming the lock
+// is already held.
+func (s *subscribers) updateCount() {
+	n := len(s.chans) + len(s.hooks)
+	if s.journal != nil {
+		n++
+	}
+	s.count.Store(int32(n))
+}
+
+// Subscribe returns a channel receiving an Event for every change in the
+// lifecycle of the tasks in this Proclist, together with a function to cancel
+// the subscription and close the channel. Events are never allowed to block
+// the tasks, so they are dropped if the subscriber is unable to keep up.
+func (pl *Proclist) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	pl.subs.mu.Lock()
+	if pl.subs.chans == nil {
+		pl.subs.chans = make(map[chan Event]struct{})
+	}
+	pl.subs.chans[ch] = struct{}{}
+	pl.subs.updateCount()
+	pl.subs.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			pl.subs.mu.Lock()
+			delete(pl.subs.chans, ch)
+			pl.subs.updateCount()
+			pl.subs.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// subscribed returns whether there's at least one subscriber for events (or a
+// journal or hooks), so that callers can skip building them otherwise. It takes
+// no locks, as it's checked on every change to every task.
+func (pl *Proclist) subscribed() bool {
+	return pl.subs.count.Load() > 0
+}
+
+// emit sends an event to all subscribers, writes it to the journal and calls
+// the hooks. The journal and hooks are handled without holding the
+// subscribers' lock.
+func (pl *Proclist) emit(ev Event) {
+	pl.subs.mu.Lock()
+	for ch := range pl.subs.chans {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	journal, hooks := pl.subs.journal, pl.subs.hooks
+	pl.subs.mu.Unlock()
+
+	if journal != nil {
+		journal.write(ev)
+	}
+	for _, entry := range hooks {
+		dispatch(entry.hooks, ev)
+	}
+}
+
+// newEvent builds an event for the process, assuming the lock is already held.
+// It returns nil for untracked processes, or if there's no one to send it to.
+// The event is to be sent with send() once the lock is released, so that hooks
+// (and the journal) never run while the process is locked.
+func (p *proc) newEvent(t EventType, ts time.Time, status string, attrs map[string]interface{}) *Event {
+	if p.gen == 0 || !p.pl.subscribed() {
+		return nil
+	}
+	ev := p.event(t, ts, status, attrs)
+	return &ev
+}
+
+// send emits an event built by newEvent(), if any. No locks should be held.
+func (pl *Proclist) send(ev *Event) {
+	if ev != nil {
+		pl.emit(*ev)
+	}
+}
+
+// event builds an event for the process, assuming the lock is already held.
+func (p *proc) event(t EventType, ts time.Time, status string, attrs map[string]interface{}) Event {
+	return Event{
+		Type:       t,
+		Id:         p.id,
+		Generation: p.gen,
+		ParentId:   p.opts.Parent,
+		Ts:         ts,
+		Status:     status,
+		Attrs:      attrs,
+	}
+}
+
+// Subscribe returns a channel receiving an Event for every change in the
+// lifecycle of the tasks in the default Proclist, together with a function to
+// cancel the subscription and close the channel. Events are never allowed to
+// block the tasks, so they are dropped if the subscriber is unable to keep up.
+func Subscribe() (<-chan Event, func()) {
+	return DefaultProclist.Subscribe()
+}
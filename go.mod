@@ -1,5 +1,5 @@
 module github.com/VividCortex/pm
 
-go 1.11
+go 1.21
 
 require github.com/VividCortex/multitick v0.0.0-20200801004505-282a3ac778f5
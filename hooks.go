@@ -0,0 +1,165 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Type Hooks gets called on changes in the lifecycle of tasks, once registered
+// with AddHooks(). Each method receives the Event describing the change (see
+// Event for the fields set in each case). OnKillRequest is called when a
+// cancellation request is accepted for a task.
+type Hooks interface {
+	OnStart(ev Event)
+	OnStatus(ev Event)
+	OnAttribute(ev Event)
+	OnKillRequest(ev Event)
+	OnDone(ev Event)
+}
+
+// Type HookFuncs implements Hooks by calling the functions set, so that only
+// the hooks of interest need to be provided.
+type HookFuncs struct {
+	Start       func(Event)
+	Status      func(Event)
+	Attribute   func(Event)
+	KillRequest func(Event)
+	Done        func(Event)
+}
+
+func (h HookFuncs) OnStart(ev Event)       { call(h.Start, ev) }
+func (h HookFuncs) OnStatus(ev Event)      { call(h.Status, ev) }
+func (h HookFuncs) OnAttribute(ev Event)   { call(h.Attribute, ev) }
+func (h HookFuncs) OnKillRequest(ev Event) { call(h.KillRequest, ev) }
+func (h HookFuncs) OnDone(ev Event)        { call(h.Done, ev) }
+
+func call(f func(Event), ev Event) {
+	if f != nil {
+		f(ev)
+	}
+}
+
+// dispatch calls the hook matching the type of the event, if any.
+func dispatch(h Hooks, ev Event) {
+	switch ev.Type {
+	case EventStart:
+		h.OnStart(ev)
+	case EventStatus:
+		h.OnStatus(ev)
+	case EventAttribute:
+		h.OnAttribute(ev)
+	case EventCancelRequest:
+		h.OnKillRequest(ev)
+	case EventDone:
+		h.OnDone(ev)
+	}
+}
+
+type hooksEntry struct {
+	hooks Hooks
+}
+
+// AddHooks registers hooks to be called for the tasks in this Proclist, and
+// returns a function to remove them. Hooks are called synchronously, from the
+// routine making the change, with no locks held; they may thus call back into
+// the Proclist, but they'd better be quick. Wrap them with NewAsyncHooks()
+// otherwise.
+func (pl *Proclist) AddHooks(h Hooks) func() {
+	entry := &hooksEntry{hooks: h}
+	pl.subs.mu.Lock()
+	pl.subs.hooks = append(pl.subs.hooks, entry)
+	pl.subs.updateCount()
+	pl.subs.mu.Unlock()
+
+	return func() {
+		pl.subs.mu.Lock()
+		defer pl.subs.mu.Unlock()
+		for i, e := range pl.subs.hooks {
+			if e == entry {
+				pl.subs.hooks = append(pl.subs.hooks[:i:i], pl.subs.hooks[i+1:]...)
+				pl.subs.updateCount()
+				break
+			}
+		}
+	}
+}
+
+// Type AsyncHooks implements Hooks by queueing events to be delivered to other
+// Hooks from a separate routine. Events are dropped (and counted) when the
+// queue is full, so that tasks never block on slow hooks.
+type AsyncHooks struct {
+	hooks   Hooks
+	mu      sync.Mutex
+	queue   chan Event
+	closed  bool
+	done    chan struct{}
+	dropped uint64
+}
+
+// NewAsyncHooks returns AsyncHooks delivering events to h, with room for size
+// events in the queue.
+func NewAsyncHooks(h Hooks, size int) *AsyncHooks {
+	a := &AsyncHooks{
+		hooks: h,
+		queue: make(chan Event, size),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		for ev := range a.queue {
+			dispatch(a.hooks, ev)
+		}
+		close(a.done)
+	}()
+	return a
+}
+
+func (a *AsyncHooks) OnStart(ev Event)       { a.enqueue(ev) }
+func (a *AsyncHooks) OnStatus(ev Event)      { a.enqueue(ev) }
+func (a *AsyncHooks) OnAttribute(ev Event)   { a.enqueue(ev) }
+func (a *AsyncHooks) OnKillRequest(ev Event) { a.enqueue(ev) }
+func (a *AsyncHooks) OnDone(ev Event)        { a.enqueue(ev) }
+
+// enqueue queues an event for delivery, or drops it if the queue is full.
+func (a *AsyncHooks) enqueue(ev Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		atomic.AddUint64(&a.dropped, 1)
+		return
+	}
+	select {
+	case a.queue <- ev:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped so far.
+func (a *AsyncHooks) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Close stops the delivery of events, waiting for those already queued to be
+// delivered. Events received afterwards are dropped.
+func (a *AsyncHooks) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+// AddHooks registers hooks to be called for the tasks in the default Proclist,
+// and returns a function to remove them. Hooks are called synchronously, from
+// the routine making the change, with no locks held; they may thus call back
+// into the Proclist, but they'd better be quick. Wrap them with NewAsyncHooks()
+// otherwise.
+func AddHooks(h Hooks) func() {
+	return DefaultProclist.AddHooks(h)
+}
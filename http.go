@@ -5,6 +5,8 @@ package pm
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -13,30 +15,65 @@ import (
 const (
 	HeaderContentType = "Content-Type"
 	MediaJSON         = "application/json"
+	MediaEventStream  = "text/event-stream"
 )
 
+// detail returns the ProcDetail for a process, assuming the lock is already
+// held.
+func (p *proc) detail() ProcDetail {
+	attrs := make(map[string]interface{})
+	for name, value := range p.attrs {
+		attrs[name] = value
+	}
+	firstHEntry := p.history.Front().Value.(*historyEntry)
+	lastHEntry := p.history.Back().Value.(*historyEntry)
+
+	detail := ProcDetail{
+		Id:         p.id,
+		Generation: p.gen,
+		ParentId:   p.opts.Parent,
+		Attrs:      attrs,
+		ProcTime:   firstHEntry.ts,
+		StatusTime: lastHEntry.ts,
+		Status:     lastHEntry.status,
+		Cancelling: p.cancel.isPending,
+		Stalled:    p.stalled,
+		Panic:      lastHEntry.panic,
+		Progress:   p.progressDetail(),
+	}
+	if !p.deadline.IsZero() {
+		deadline := p.deadline
+		detail.Deadline = &deadline
+		if p.ended.IsZero() {
+			detail.Remaining = time.Until(deadline)
+		} else {
+			detail.Remaining = deadline.Sub(p.ended)
+		}
+	}
+	return detail
+}
+
 func (pl *Proclist) getProcs() []ProcDetail {
 	pl.mu.RLock()
 	defer pl.mu.RUnlock()
 	procs := make([]ProcDetail, 0, len(pl.procs))
 
-	for id, p := range pl.procs {
+	for _, p := range pl.procs {
 		p.mu.RLock()
-		attrs := make(map[string]interface{})
-		for name, value := range p.attrs {
-			attrs[name] = value
-		}
-		firstHEntry := p.history.Front().Value.(*historyEntry)
-		lastHEntry := p.history.Back().Value.(*historyEntry)
-
-		procs = append(procs, ProcDetail{
-			Id:         id,
-			Attrs:      attrs,
-			ProcTime:   firstHEntry.ts,
-			StatusTime: lastHEntry.ts,
-			Status:     lastHEntry.status,
-			Cancelling: p.cancel.isPending,
-		})
+		procs = append(procs, p.detail())
+		p.mu.RUnlock()
+	}
+
+	return procs
+}
+
+func (pl *Proclist) getDoneProcs() []ProcDetail {
+	done := pl.doneProcs()
+	procs := make([]ProcDetail, 0, len(done))
+
+	for _, p := range done {
+		p.mu.RLock()
+		procs = append(procs, p.detail())
 		p.mu.RUnlock()
 	}
 
@@ -48,8 +85,56 @@ func httpError(w http.ResponseWriter, httpCode int) {
 }
 
 func (pl *Proclist) handleProclistReq(w http.ResponseWriter, r *http.Request) {
+	q, err := ParseProcQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	procs, total := q.apply(pl.getProcs(), now)
+
+	b, err := json.Marshal(ProcResponse{
+		Procs:      procs,
+		Total:      total,
+		Draining:   pl.Draining(),
+		ServerTime: now,
+	})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(HeaderContentType, MediaJSON)
+	w.Write(b)
+}
+
+func (pl *Proclist) getChildren(id string) ([]ProcDetail, error) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	p, present := pl.procs[id]
+	if !present {
+		return []ProcDetail{}, ErrNoSuchProcess
+	}
+	descendants := p.descendants()
+	procs := make([]ProcDetail, 0, len(descendants))
+
+	for _, d := range descendants {
+		d.mu.RLock()
+		procs = append(procs, d.detail())
+		d.mu.RUnlock()
+	}
+
+	return procs, nil
+}
+
+func (pl *Proclist) handleChildrenReq(w http.ResponseWriter, r *http.Request, id string) {
+	children, err := pl.getChildren(id)
+	if err != nil {
+		httpError(w, http.StatusNotFound)
+		return
+	}
 	b, err := json.Marshal(ProcResponse{
-		Procs:      pl.getProcs(),
+		Procs:      children,
 		ServerTime: time.Now(),
 	})
 	if err != nil {
@@ -60,13 +145,59 @@ func (pl *Proclist) handleProclistReq(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func (pl *Proclist) handleDoneReq(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(ProcResponse{
+		Procs:      pl.getDoneProcs(),
+		ServerTime: time.Now(),
+	})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(HeaderContentType, MediaJSON)
+	w.Write(b)
+}
+
+func (pl *Proclist) handleEventsReq(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusNotImplemented)
+		return
+	}
+	events, unsubscribe := pl.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set(HeaderContentType, MediaEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case ev := <-events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
 func (pl *Proclist) getHistory(id string) ([]HistoryDetail, error) {
 	pl.mu.RLock()
 	p, present := pl.procs[id]
 	pl.mu.RUnlock()
 
 	if !present {
-		return []HistoryDetail{}, ErrNoSuchProcess
+		if p, present = pl.findDone(id); !present {
+			return []HistoryDetail{}, ErrNoSuchProcess
+		}
 	}
 
 	p.mu.RLock()
@@ -79,6 +210,7 @@ func (pl *Proclist) getHistory(id string) ([]HistoryDetail, error) {
 		history = append(history, HistoryDetail{
 			Ts:     v.ts,
 			Status: v.status,
+			Panic:  v.panic,
 		})
 		entry = entry.Next()
 	}
@@ -90,6 +222,7 @@ func (pl *Proclist) handleHistoryReq(w http.ResponseWriter, r *http.Request, id
 	history, err := pl.getHistory(id)
 	if err != nil {
 		httpError(w, http.StatusNotFound)
+		return
 	}
 	b, err := json.Marshal(HistoryResponse{
 		History:    history,
@@ -105,11 +238,16 @@ func (pl *Proclist) handleHistoryReq(w http.ResponseWriter, r *http.Request, id
 
 func (pl *Proclist) handleCancelReq(w http.ResponseWriter, r *http.Request, id string) {
 	var message string
+	var gen uint64
 	var cancel CancelRequest
 	if err := json.NewDecoder(r.Body).Decode(&cancel); err == nil {
-		message = cancel.Message
+		message, gen = cancel.Message, cancel.Generation
 	}
-	if err := pl.Kill(id, message); err != nil {
+	err := ErrNoSuchProcess
+	if p, present := pl.lookup(id); present && (gen == 0 || gen == p.gen) {
+		err = pl.kill(p, time.Now(), message)
+	}
+	if err != nil {
 		httpCode := http.StatusNotFound
 		if err == ErrForbidden {
 			httpCode = http.StatusForbidden
@@ -118,12 +256,37 @@ func (pl *Proclist) handleCancelReq(w http.ResponseWriter, r *http.Request, id s
 	}
 }
 
+func (pl *Proclist) handleKillReq(w http.ResponseWriter, r *http.Request) {
+	var kill KillRequest
+	if err := json.NewDecoder(r.Body).Decode(&kill); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if kill.Filter.isZero() {
+		// Refuse to kill everything just because of a missing filter
+		http.Error(w, "empty filter", http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(pl.KillMatching(kill.Filter, kill.Message))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(HeaderContentType, MediaJSON)
+	w.Write(b)
+}
+
 func (pl *Proclist) handleProcsReq(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if pl.authorizer() == nil {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
 
 	path := r.URL.Path
 	if path == "/procs/" {
 		if r.Method == "GET" {
+			if !pl.authorize(w, r, PermRead, "") {
+				return
+			}
 			pl.handleProclistReq(w, r)
 		} else {
 			httpError(w, http.StatusMethodNotAllowed)
@@ -144,7 +307,32 @@ func (pl *Proclist) handleProcsReq(w http.ResponseWriter, r *http.Request) {
 	id := subdir[:sep]
 	subdir = subdir[sep:]
 
+	switch r.Method {
+	case "GET":
+		if !pl.authorize(w, r, PermRead, id) {
+			return
+		}
+	case "DELETE", "POST":
+		// Requests to /procs/kill and /procs/drain don't target a single task
+		target := id
+		if (id == "kill" || id == "drain") && (subdir == "" || subdir == "/") && r.Method == "POST" {
+			target = ""
+		}
+		if !pl.authorize(w, r, PermWrite, target) {
+			return
+		}
+	}
+
 	switch {
+	case id == "done" && (subdir == "" || subdir == "/") && r.Method == "GET":
+		pl.handleDoneReq(w, r)
+	case id == "events" && (subdir == "" || subdir == "/") && r.Method == "GET":
+		pl.handleEventsReq(w, r)
+	case id == "kill" && (subdir == "" || subdir == "/") && r.Method == "POST":
+		pl.handleKillReq(w, r)
+	case id == "drain" && (subdir == "" || subdir == "/") &&
+		(r.Method == "GET" || r.Method == "POST"):
+		pl.handleDrainReq(w, r)
 	case subdir == "" || subdir == "/":
 		if r.Method == "DELETE" {
 			pl.handleCancelReq(w, r, id)
@@ -159,17 +347,84 @@ func (pl *Proclist) handleProcsReq(w http.ResponseWriter, r *http.Request) {
 		} else {
 			httpError(w, http.StatusMethodNotAllowed)
 		}
+	case subdir == "/stack":
+		if r.Method == "GET" {
+			pl.handleStackReq(w, r, id)
+		} else {
+			httpError(w, http.StatusMethodNotAllowed)
+		}
+	case subdir == "/log":
+		if r.Method == "GET" {
+			pl.handleLogReq(w, r, id)
+		} else {
+			httpError(w, http.StatusMethodNotAllowed)
+		}
+	case subdir == "/children":
+		if r.Method == "GET" {
+			pl.handleChildrenReq(w, r, id)
+		} else {
+			httpError(w, http.StatusMethodNotAllowed)
+		}
 	default:
 		httpError(w, http.StatusNotFound)
 	}
 }
 
+// Handler returns an http.Handler serving the HTTP interface for this Proclist,
+// so that it can be mounted at any router. All paths are relative to prefix
+// (e.g., "/debug/pm" would serve "/debug/pm/procs/"), which may be empty.
+func (pl *Proclist) Handler(prefix string) http.Handler {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/procs/", pl.handleProcsReq)
+	serveMux.HandleFunc("/metrics", pl.handleMetricsReq)
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return serveMux
+	}
+	return http.StripPrefix(prefix, serveMux)
+}
+
+// NewServer returns an HTTP server for this Proclist, set to listen at the given
+// address. The server can be customized (e.g., setting timeouts or TLS) before
+// starting it, and stopped with its Shutdown() method.
+func (pl *Proclist) NewServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:    addr,
+		Handler: pl.Handler(""),
+	}
+}
+
+// Serve accepts incoming HTTP connections on the listener, serving requests for
+// this Proclist. It returns when the listener fails or is closed.
+func (pl *Proclist) Serve(l net.Listener) error {
+	return http.Serve(l, pl.Handler(""))
+}
+
 // ListenAndServe starts an HTTP server at the given address (localhost:80
 // by default, as results from the underlying net/http implementation).
 func (pl *Proclist) ListenAndServe(addr string) error {
-	serveMux := http.NewServeMux()
-	serveMux.HandleFunc("/procs/", pl.handleProcsReq)
-	return http.ListenAndServe(addr, serveMux)
+	return pl.NewServer(addr).ListenAndServe()
+}
+
+// Handler returns an http.Handler serving the HTTP interface for the default
+// Proclist, so that it can be mounted at any router. All paths are relative to
+// prefix (e.g., "/debug/pm" would serve "/debug/pm/procs/"), which may be empty.
+func Handler(prefix string) http.Handler {
+	return DefaultProclist.Handler(prefix)
+}
+
+// NewServer returns an HTTP server for the default Proclist, set to listen at
+// the given address. The server can be customized (e.g., setting timeouts or
+// TLS) before starting it, and stopped with its Shutdown() method.
+func NewServer(addr string) *http.Server {
+	return DefaultProclist.NewServer(addr)
+}
+
+// Serve accepts incoming HTTP connections on the listener, serving requests for
+// the default Proclist. It returns when the listener fails or is closed.
+func Serve(l net.Listener) error {
+	return DefaultProclist.Serve(l)
 }
 
 // ListenAndServe starts an HTTP server at the given address (localhost:80
@@ -0,0 +1,276 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var ErrBadJournal = errors.New("malformed journal entry")
+
+// Type JournalOpts sets the rotation policy for a Journal. The journal file is
+// rotated once it grows beyond MaxSize bytes (never if zero), keeping at most
+// MaxFiles rotated files (named path.1, path.2 and so on, path.1 being the
+// most recent).
+type JournalOpts struct {
+	MaxSize  int64
+	MaxFiles int
+}
+
+// Type Journal appends the lifecycle events of the tasks in a Proclist to a
+// file, as JSON lines, so that a durable record is left even if the process
+// crashes. Events are written synchronously as they happen, from the routine
+// making the change but with no locks held, so that slow writes only delay that
+// routine; see SetJournal().
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	opts JournalOpts
+	f    *os.File
+	size int64
+	err  error
+}
+
+// OpenJournal opens the journal file at the given path for appending, creating
+// it if needed.
+func OpenJournal(path string, opts JournalOpts) (*Journal, error) {
+	j := &Journal{
+		path: path,
+		opts: opts,
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// open opens the journal file, assuming the lock is held (or not needed).
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f, j.size = f, fi.Size()
+	return nil
+}
+
+// rotate renames the journal file and its rotated copies, discarding the
+// oldest, and starts a new file. The lock is assumed to be held.
+func (j *Journal) rotate() error {
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	j.f = nil
+	if j.opts.MaxFiles > 0 {
+		for i := j.opts.MaxFiles - 1; i > 0; i-- {
+			old := j.path + "." + strconv.Itoa(i)
+			if err := os.Rename(old, j.path+"."+strconv.Itoa(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(j.path, j.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(j.path); err != nil {
+		return err
+	}
+	return j.open()
+}
+
+// write appends an event to the journal, rotating the file as needed. Errors
+// are kept to be reported by Err(), as events can't fail.
+func (j *Journal) write(ev Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		j.err = err
+		return
+	}
+	line = append(line, '\n')
+	n, err := j.f.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		j.err = err
+		return
+	}
+	if j.opts.MaxSize > 0 && j.size >= j.opts.MaxSize {
+		if err := j.rotate(); err != nil {
+			j.err = err
+		}
+	}
+}
+
+// Err returns the last error found while writing to the journal, if any.
+func (j *Journal) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// Close closes the journal file. Events emitted afterwards are discarded, so
+// the journal should be removed from the Proclist first.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// SetJournal sets the Journal where every lifecycle event for this Proclist is
+// written. Unlike subscribers, the journal never misses events. A nil Journal
+// (the default) disables journaling.
+func (pl *Proclist) SetJournal(j *Journal) {
+	pl.subs.mu.Lock()
+	defer pl.subs.mu.Unlock()
+	pl.subs.journal = j
+	pl.subs.updateCount()
+}
+
+// ReadJournal reconstructs the tasks recorded in the journal at the given path,
+// including its rotated files, in the order they started. Tasks with an empty
+// Outcome never ended, so they were still running when the journal was last
+// written to, as after a crash. Tasks started before the oldest entry available
+// are reported as well, with partial data.
+func ReadJournal(path string) ([]JournalTask, error) {
+	var files []string
+	for i := 1; ; i++ {
+		name := path + "." + strconv.Itoa(i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		files = append([]string{name}, files...)
+	}
+	files = append(files, path)
+
+	var r journalReader
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		err = r.read(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.tasks, nil
+}
+
+// journalReader rebuilds tasks out of journal events. Running tasks are told
+// apart by their generation, given that identifiers may be reused. Events from
+// different routines may be written out of order, so those found for tasks
+// already ended are dropped.
+type journalReader struct {
+	tasks   []JournalTask
+	running map[journalKey]int
+	ended   map[journalKey]bool
+}
+
+type journalKey struct {
+	id  string
+	gen uint64
+}
+
+// read processes all events from r. A malformed line is only accepted last,
+// lacking its newline, as would result from a crash while writing.
+func (jr *journalReader) read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var ev Event
+			if jerr := json.Unmarshal(line, &ev); jerr != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return ErrBadJournal
+			}
+			jr.apply(ev)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// apply updates the tasks as per a single event. Refused cancellation requests
+// are only recorded for tasks known to be running.
+func (jr *journalReader) apply(ev Event) {
+	if jr.running == nil {
+		jr.running = make(map[journalKey]int)
+		jr.ended = make(map[journalKey]bool)
+	}
+	key := journalKey{id: ev.Id, gen: ev.Generation}
+	i, present := jr.running[key]
+	if ev.Type == EventCancelDenied && !present || ev.Generation != 0 && jr.ended[key] {
+		return
+	}
+	if !present || ev.Type == EventStart {
+		jr.tasks = append(jr.tasks, JournalTask{
+			Id:         ev.Id,
+			Generation: ev.Generation,
+			ParentId:   ev.ParentId,
+			Attrs:      make(map[string]interface{}),
+		})
+		i = len(jr.tasks) - 1
+		jr.running[key] = i
+	}
+	t := &jr.tasks[i]
+
+	switch ev.Type {
+	case EventStart:
+		for name, value := range ev.Attrs {
+			t.Attrs[name] = value
+		}
+	case EventAttribute:
+		for name, value := range ev.Attrs {
+			if value == nil {
+				delete(t.Attrs, name)
+			} else {
+				t.Attrs[name] = value
+			}
+		}
+	case EventDone:
+		t.Outcome = ev.Outcome
+		delete(jr.running, key)
+		jr.ended[key] = true
+	}
+	switch ev.Type {
+	case EventStart, EventStatus, EventCancelRequest, EventCancelDenied, EventDone:
+		t.History = append(t.History, HistoryDetail{Ts: ev.Ts, Status: ev.Status, Panic: ev.Panic})
+	}
+}
+
+// SetJournal sets the Journal where every lifecycle event for the default
+// Proclist is written. Unlike subscribers, the journal never misses events. A
+// nil Journal (the default) disables journaling.
+func SetJournal(j *Journal) {
+	DefaultProclist.SetJournal(j)
+}
@@ -0,0 +1,109 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+)
+
+// LabelTaskId is the pprof label holding the task identifier, for goroutines
+// running tasks when the ProfileLabels option is set.
+const LabelTaskId = "pm_task"
+
+// setLabels applies pprof labels for the task to the calling goroutine, if the
+// ProfileLabels option is set for the Proclist. Labels are derived from ctx,
+// that is also kept to restore them when the task is done. The resulting
+// context is returned, carrying the labels for the task.
+func (pl *Proclist) setLabels(ctx context.Context, p *proc) context.Context {
+	opts := pl.Options()
+	if !opts.ProfileLabels {
+		return ctx
+	}
+
+	labels := []string{LabelTaskId, p.id}
+	p.mu.RLock()
+	for _, name := range opts.ProfileAttrs {
+		if value, present := p.attrs[name]; present && name != LabelTaskId {
+			labels = append(labels, name, fmt.Sprint(value))
+		}
+	}
+	p.mu.RUnlock()
+
+	p.labelsCtx = ctx
+	labeled := pprof.WithLabels(ctx, pprof.Labels(labels...))
+	pprof.SetGoroutineLabels(labeled)
+	return labeled
+}
+
+// restoreLabels restores the pprof labels the calling goroutine had before
+// the task was started.
+func (p *proc) restoreLabels() {
+	if p.labelsCtx != nil {
+		pprof.SetGoroutineLabels(p.labelsCtx)
+	}
+}
+
+// writeStacks writes the stack traces of all goroutines labelled with the given
+// task identifier, in the format used by the goroutine profile with debug=1.
+func writeStacks(w io.Writer, id string) error {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return err
+	}
+	label := strconv.Quote(LabelTaskId) + ":" + strconv.Quote(id)
+
+	// Stacks are separated by blank lines, with a "# labels:" line following
+	// the first one when the goroutines were labelled
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(nil, 1<<20)
+	var block []string
+	flush := func() error {
+		for _, line := range block {
+			if strings.HasPrefix(line, "# labels: ") &&
+				(strings.Contains(line, label+",") || strings.Contains(line, label+"}")) {
+				_, err := io.WriteString(w, strings.Join(block, "\n")+"\n\n")
+				return err
+			}
+		}
+		return nil
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if err := flush(); err != nil {
+				return err
+			}
+			block = block[:0]
+			continue
+		}
+		block = append(block, line)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+func (pl *Proclist) handleStackReq(w http.ResponseWriter, r *http.Request, id string) {
+	if _, present := pl.lookup(id); !present {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	// Without labels no goroutine could be found, so don't pretend there's none
+	if !pl.Options().ProfileLabels {
+		http.Error(w, "stacks unavailable: ProfileLabels option not set",
+			http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set(HeaderContentType, "text/plain; charset=utf-8")
+	writeStacks(w, id)
+}
@@ -0,0 +1,178 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// taskKey is the context key for the process running a task.
+type taskKey struct{}
+
+// procFromContext returns the process for the task whose context is ctx (or
+// derives from it), if any.
+func procFromContext(ctx context.Context) *proc {
+	if ctx == nil {
+		return nil
+	}
+	p, _ := ctx.Value(taskKey{}).(*proc)
+	return p
+}
+
+// logAttrs returns the identifier of the process and the attributes named, as
+// attributes for log records.
+func (p *proc) logAttrs(names []string) []slog.Attr {
+	attrs := []slog.Attr{slog.String(LabelTaskId, p.id)}
+	if len(names) == 0 {
+		return attrs
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, name := range names {
+		if value, present := p.attrs[name]; present && name != LabelTaskId {
+			attrs = append(attrs, slog.Any(name, value))
+		}
+	}
+	return attrs
+}
+
+// Type LogHandler is an slog.Handler that enriches log records with the task
+// found in the context given to the logger (as with slog.InfoContext() and
+// alike), if any. The task identifier is added under the LabelTaskId key,
+// together with the task attributes named when creating the handler. Records
+// are then passed on to the wrapped handler.
+type LogHandler struct {
+	handler slog.Handler
+	attrs   []string
+}
+
+// NewLogHandler returns a LogHandler wrapping h, that adds the given task
+// attributes to records besides the task identifier.
+func NewLogHandler(h slog.Handler, attrs ...string) *LogHandler {
+	return &LogHandler{
+		handler: h,
+		attrs:   attrs,
+	}
+}
+
+func (h *LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if p := procFromContext(ctx); p != nil {
+		r = r.Clone()
+		r.AddAttrs(p.logAttrs(h.attrs)...)
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return NewLogHandler(h.handler.WithAttrs(attrs), h.attrs...)
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return NewLogHandler(h.handler.WithGroup(name), h.attrs...)
+}
+
+// taskHandler is the slog.Handler for task loggers. Records are tagged with
+// the task identifier, and those at or above level are added to history if
+// enabled. The attributes set with WithAttrs() are kept for history as well,
+// qualified by the current group, if any.
+type taskHandler struct {
+	handler slog.Handler
+	p       *proc
+	history bool
+	level   slog.Level
+	attrs   []slog.Attr
+	group   string
+}
+
+// toHistory tells whether records at the given level are added to history.
+func (h *taskHandler) toHistory(level slog.Level) bool {
+	return h.history && level >= h.level
+}
+
+func (h *taskHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.toHistory(level) || h.handler.Enabled(ctx, level)
+}
+
+func (h *taskHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.toHistory(r.Level) {
+		h.p.addLogEntry(r, h.attrs, h.group)
+	}
+	if !h.handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	r = r.Clone()
+	r.AddAttrs(slog.String(LabelTaskId, h.p.id))
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *taskHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.handler = h.handler.WithAttrs(attrs)
+	h2.attrs = make([]slog.Attr, len(h.attrs), len(h.attrs)+len(attrs))
+	copy(h2.attrs, h.attrs)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, slog.Attr{Key: h.group + a.Key, Value: a.Value})
+	}
+	return &h2
+}
+
+func (h *taskHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.handler = h.handler.WithGroup(name)
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// addLogEntry adds a log record to the history of the process, with its level
+// and attributes (preceded by those given, and qualifying the record's with
+// group), unless the process has already ended. Unlike a status change, this is
+// not a cancellation point.
+func (p *proc) addLogEntry(r slog.Record, attrs []slog.Attr, group string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", r.Level, r.Message)
+	for _, a := range attrs {
+		fmt.Fprintf(&b, " %s", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s%s", group, a)
+		return true
+	})
+	ts := time.Now()
+
+	p.mu.Lock()
+	if !p.ended.IsZero() {
+		p.mu.Unlock()
+		return
+	}
+	p.addHistoryEntry(ts, b.String())
+	ev := p.newEvent(EventStatus, ts, b.String(), nil)
+	p.mu.Unlock()
+	p.pl.send(ev)
+}
+
+// Logger returns a logger for the task. Records are tagged with the task
+// identifier and handled by the LogHandler option (slog's default handler if
+// unset). If the LogHistory option is set, those at or above the
+// LogHistoryLevel option are added to the task's history as well.
+func (t *Task) Logger() *slog.Logger {
+	opts := t.p.pl.Options()
+	handler := opts.LogHandler
+	if handler == nil {
+		handler = slog.Default().Handler()
+	}
+	return slog.New(&taskHandler{
+		handler: handler,
+		p:       t.p,
+		history: opts.LogHistory,
+		level:   opts.LogHistoryLevel,
+	})
+}
@@ -0,0 +1,221 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MediaPrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+// MaxMetricsStatuses is the number of distinct statuses tracked by the status
+// duration histograms. Time spent in statuses beyond those is accounted to
+// OtherStatus, so that free-form statuses can't grow metrics without bound.
+const MaxMetricsStatuses = 100
+
+// OtherStatus is the status label for time spent in statuses beyond the first
+// MaxMetricsStatuses seen.
+const OtherStatus = "other"
+
+// durationBuckets are the upper bounds, in seconds, for the duration histograms.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets)+1)
+	}
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(durationBuckets, secs)
+	h.counts[i]++
+	h.sum += secs
+	h.count++
+}
+
+// metrics holds the counters and histograms for finished tasks. Gauges for
+// running tasks are computed when metrics are requested.
+type metrics struct {
+	mu             sync.Mutex
+	finished       map[string]uint64
+	duration       map[string]*histogram
+	statusDuration map[string]*histogram
+}
+
+// observe records the metrics for a finished process, assuming the process'
+// lock is already held. Time spent in cancellation request markers is
+// accounted to the status set before them, and that in statuses beyond
+// MaxMetricsStatuses to OtherStatus.
+func (m *metrics) observe(p *proc, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.finished == nil {
+		m.finished = make(map[string]uint64)
+		m.duration = make(map[string]*histogram)
+		m.statusDuration = make(map[string]*histogram)
+	}
+	m.finished[outcome]++
+
+	first := p.history.Front().Value.(*historyEntry)
+	last := p.history.Back().Value.(*historyEntry)
+	histogramFor(m.duration, outcome).observe(last.ts.Sub(first.ts))
+
+	current := first
+	for entry := p.history.Front().Next(); entry != nil; entry = entry.Next() {
+		v := entry.Value.(*historyEntry)
+		if strings.HasPrefix(v.status, "[") && entry != p.history.Back() {
+			continue
+		}
+		label := current.status
+		if _, present := m.statusDuration[label]; !present && len(m.statusDuration) >= MaxMetricsStatuses {
+			label = OtherStatus
+		}
+		histogramFor(m.statusDuration, label).observe(v.ts.Sub(current.ts))
+		current = v
+	}
+}
+
+func histogramFor(m map[string]*histogram, label string) *histogram {
+	h, present := m[label]
+	if !present {
+		h = &histogram{}
+		m[label] = h
+	}
+	return h
+}
+
+// WriteMetrics writes metrics for this Proclist in the Prometheus text
+// exposition format. The gauge of running tasks is labelled by status and by
+// the attributes listed in the MetricsAttrs option.
+func (pl *Proclist) WriteMetrics(w io.Writer) error {
+	labels := metricsLabels(pl.Options().MetricsAttrs)
+	active := make(map[string]int)
+	for _, p := range pl.getProcs() {
+		var sb strings.Builder
+		sb.WriteString(`status="` + escapeLabel(p.Status) + `"`)
+		for _, l := range labels {
+			var value string
+			if v, present := p.Attrs[l.attr]; present {
+				value = fmt.Sprint(v)
+			}
+			sb.WriteString(`,` + l.name + `="` + escapeLabel(value) + `"`)
+		}
+		active[sb.String()]++
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP pm_tasks_active Number of running tasks.")
+	fmt.Fprintln(bw, "# TYPE pm_tasks_active gauge")
+	for _, key := range sortedKeys(active) {
+		fmt.Fprintf(bw, "pm_tasks_active{%s} %d\n", key, active[key])
+	}
+
+	pl.metrics.mu.Lock()
+	fmt.Fprintln(bw, "# HELP pm_tasks_finished_total Number of finished tasks by outcome.")
+	fmt.Fprintln(bw, "# TYPE pm_tasks_finished_total counter")
+	for _, outcome := range sortedKeys(pl.metrics.finished) {
+		fmt.Fprintf(bw, "pm_tasks_finished_total{outcome=\"%s\"} %d\n",
+			outcome, pl.metrics.finished[outcome])
+	}
+	writeHistograms(bw, "pm_task_duration_seconds", "Duration of finished tasks.",
+		"outcome", pl.metrics.duration)
+	writeHistograms(bw, "pm_task_status_duration_seconds",
+		"Time spent by finished tasks in each status.", "status", pl.metrics.statusDuration)
+	pl.metrics.mu.Unlock()
+
+	return bw.Flush()
+}
+
+func writeHistograms(w io.Writer, name, help, label string, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, key := range sortedKeys(hs) {
+		h := hs[key]
+		value := escapeLabel(key)
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"%s\"} %d\n", name, label, value,
+				strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n", name, label, value, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %s\n", name, label, value,
+			strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", name, label, value, h.count)
+	}
+}
+
+type metricsLabel struct {
+	attr, name string
+}
+
+// metricsLabels maps attribute names to valid Prometheus label names. Invalid
+// characters are replaced with underscores, and names clashing with others
+// (including the reserved "status") are skipped.
+func metricsLabels(attrs []string) []metricsLabel {
+	seen := map[string]bool{"status": true}
+	labels := make([]metricsLabel, 0, len(attrs))
+	for _, attr := range attrs {
+		name := []byte(attr)
+		for i, c := range name {
+			if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				i > 0 && c >= '0' && c <= '9') {
+				name[i] = '_'
+			}
+		}
+		if len(name) == 0 || seen[string(name)] || strings.HasPrefix(string(name), "__") {
+			continue
+		}
+		seen[string(name)] = true
+		labels = append(labels, metricsLabel{attr: attr, name: string(name)})
+	}
+	return labels
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (pl *Proclist) handleMetricsReq(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	if !pl.authorize(w, r, PermRead, "") {
+		return
+	}
+	w.Header().Set(HeaderContentType, MediaPrometheus)
+	pl.WriteMetrics(w)
+}
+
+// WriteMetrics writes metrics for the default Proclist in the Prometheus text
+// exposition format. The gauge of running tasks is labelled by status and by
+// the attributes listed in the MetricsAttrs option.
+func WriteMetrics(w io.Writer) error {
+	return DefaultProclist.WriteMetrics(w)
+}
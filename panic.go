@@ -0,0 +1,38 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// newPanicDetail captures the details of a panic with value e. It must be
+// called from the deferred functions run while panicking, where the frames
+// leading to the panic are still in the stack.
+func newPanicDetail(e interface{}) *PanicDetail {
+	detail := &PanicDetail{
+		Value: fmt.Sprint(e),
+		Stack: string(debug.Stack()),
+	}
+
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	panicking := false
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "runtime.gopanic" {
+			panicking = true
+		} else if panicking && !strings.HasPrefix(frame.Function, "runtime.") {
+			detail.Location = fmt.Sprintf("%s (%s:%d)", frame.Function, frame.File, frame.Line)
+			break
+		}
+		if !more {
+			break
+		}
+	}
+	return detail
+}
@@ -18,6 +18,28 @@ Note that pm's ListenAndServe() will not return by itself. Nevertheless, it will
 if the underlying net/http's ListenAndServe() does. So it's probably a good idea
 to wrap that call with some error checking and retrying for production code.
 
+Programs needing more control over the server may use NewServer() instead, that
+returns an *http.Server ready to be customized (think of timeouts or TLS) and
+shut down at will. Serve() takes a listener provided by the application. To
+mount pm within an existing router, use Handler() with the path prefix where the
+interface should live:
+
+	mux.Handle("/debug/pm/", pm.Handler("/debug/pm"))
+
+The interface can be served over HTTPS with ListenAndServeTLS(). When given a
+file with certificate authorities, clients are also required to present a valid
+certificate signed by one of them (mutual TLS):
+
+	go pm.ListenAndServeTLS(":8443", "server.pem", "server-key.pem", "clients-ca.pem")
+
+The client package and pm-cli (see the -ca, -cert and -key flags) support TLS
+as well.
+
+Processes may instead listen on a Unix domain socket with ListenAndServeUnix(),
+so that filesystem permissions on the socket control access to the interface.
+The client package and pm-cli connect to such endpoints with URIs like
+"unix:///run/app/pm.sock".
+
 Tasks to be tracked must be declared with Start(); that's when the identifier
 gets linked to them. An optional set of (arbitrary) attributes may be provided,
 that will get attached to the running task and be reported to the HTTP client
@@ -43,16 +65,24 @@ was started (as per the server clock) as well as the complete set of attributes
 provided to Start(). Note that to avoid issues with clock skews among servers,
 the current time for the server is returned as well.
 
+Programs running many tasks at once may add query parameters to the /procs/ GET
+so that only the interesting ones are returned. Tasks can be filtered by status
+("status", possibly repeated), attribute values ("attr.<name>=<value>"),
+attribute prefixes ("attrPrefix.<name>=<prefix>"), minimum age ("minAge", as in
+"5s") and pending cancellation ("cancelling"), sorted ("sort", one of procTime,
+statusTime or id, prefixed with "-" for descending order) and paginated ("limit"
+and "offset"). See ProcQuery for details.
+
 The reply to the /procs/ GET also includes a status. When tasks start they are
 set to "init", but they may change their status using pm's Status() function.
 Each call will record the change and the HTTP client will receive the last
 status available, together with the time it was set. Furthermore, the client may
 GET /procs/<id>/history instead (where <id> is the task identifier) to have a
 complete history for the given task, including all status changes with their
-time information. However, note that task information is completely recycled as
-soon as a task is Done(). Hence, client applications should be prepared to
-receive a not found reply even if they've just seen the task in a /procs/ GET
-result.
+time information. However, note that task information is recycled once a task
+is Done(), unless retained as explained below. Hence, client applications should
+be prepared to receive a not found reply even if they've just seen the task in a
+/procs/ GET result.
 
 Given the lack of a statement in Go to kill a routine, cancellations are
 implemented as panics. A DELETE call to /procs/<id> will mark the task with the
@@ -78,6 +108,19 @@ specifically tailored to panics raising from pending cancellation requests.
 Should any other panic arise for any reason, it will continue past Done() as
 usual. So will panics due to cancel requests if StopCancelPanic is not set.
 
+Other panics may be stopped at Done() as well, by setting the StopAbortPanic
+option. The task is then recorded as "aborted" (with the panic details) and the
+routine carries on just as described above, sparing background workers their
+own recover() wrappers. An AbortHandler may be set to learn about such panics,
+receiving the task identifier and the panic value:
+
+	pm.SetOptions(ProclistOpts{
+		StopAbortPanic: true,
+		AbortHandler: func(id string, e interface{}) {
+			log.Printf("task %s aborted: %v", id, e)
+		},
+	})
+
 Options set with pm.SetOptions() work on a global scope for the process list.
 Alternatively, you may provide a specific set for some task by using the options
 argument in the Start() call. If none is given, pm will grab the current global
@@ -88,13 +131,43 @@ Attempts by clients to cancel one of such tasks will inevitably yield an error
 message with no other effects. Set that with the global SetOptions() function
 and none of your tasks will cancel, ever.
 
+Several tasks may be canceled at once with KillMatching(), given a ProcFilter
+on attributes, status and age. The same is available to HTTP clients with a
+POST to /procs/kill, including a KillRequest as the body. The reply lists the
+tasks marked for cancellation, as well as those where it was forbidden.
+
+Before shutting down, programs may call Drain() to have the process list reject
+new tasks and wait for the running ones to finish. Tasks still running when the
+context given to Drain() is done get a cancellation request, and the function
+returns a report of the tasks that ended and those that were killed. Note that
+rejected tasks are not tracked at all: StartE() and StartTaskE() return
+ErrDraining, while StartTask() returns a handle with its context canceled.
+Draining may be triggered with a POST to /procs/drain as well, giving the grace
+period in nanoseconds (such as {"grace": 30000000000} for 30 seconds), and its
+state is reported by /procs/ and a GET to /procs/drain.
+
 HTTP clients can learn about pending cancellation requests. Furthermore, if a
 client request happens to be handled between the task is done/canceled and
 resource recycling (a VERY tiny time window), then the result would include one
 of these as the status: "killed", "aborted" or "ended", if it was respectively
 canceled, died out of another panic (not pm-related) or finished successfully.
 The "killed" status may optionally add a user-defined message, provided through
-the HTTP /procs/<id> DELETE method.
+the HTTP /procs/<id> DELETE method. For aborted tasks, the last history entry
+(as well as the task in /procs/done) holds the panic value, the location where
+it was raised and the stack trace, so that they can be told without resorting
+to the program's output.
+
+Code not allowed to panic across package boundaries may use StatusE() and
+CheckCancelE() instead. They work as cancellation points too, but report a
+pending cancellation by returning the CancelErr as an ordinary error. Setting
+the CancelMode option to CancelError for a task (or globally) further prevents
+Status() and CheckCancel() from panicking at all. Either way, a task that got
+the cancellation error is recorded as killed when it's Done(), even if it
+returned normally:
+
+	if err := pm.StatusE(requestID, "querying"); err != nil {
+		return err // Done() will record the task as killed
+	}
 
 For the cancellation feature to be useful, applications should collaborate. Go
 lacks a mechanism to cancel arbitrary routines (it even lacks identifiers for
@@ -105,12 +178,177 @@ change status that frequently. This package provides the function CheckCancel()
 for that. It works as a cancellation point by definition, without messing with
 the task status, nor leaving a trace in history.
 
+Applications that rely on libraries honoring contexts (net/http, database/sql
+and the like) may prefer StartContext() instead of Start(). It returns a context
+that gets canceled as soon as a cancellation request arrives, so that blocked
+I/O is interrupted right away instead of waiting for the next cancellation
+point. The cause for the cancellation, as returned by context.Cause(), is the
+same CancelErr used for panics:
+
+	ctx := pm.StartContext(req.Context(), requestID, nil, nil)
+	defer pm.Done(requestID)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		if _, canceled := context.Cause(ctx).(pm.CancelErr); canceled {
+			// the task was killed while waiting for the query
+		}
+	}
+
+The context is canceled as well when the task is Done(). Note that tasks with
+the ForbidCancel option set never get their contexts canceled by a Kill().
+
+Clients wishing to follow tasks as they change, instead of polling /procs/, may
+GET /procs/events. That's a Server-Sent Events stream, pushing an Event (encoded
+as JSON) whenever a task starts, changes its status or attributes, gets a
+cancellation request or is done. Go code may get the same events from a channel
+by calling Subscribe().
+
+Logging, metrics or tracing may be attached to task lifecycles by registering
+Hooks with AddHooks(). Their methods (OnStart, OnStatus, OnAttribute,
+OnKillRequest and OnDone) are called synchronously with the matching Event, so
+they'd better be quick, but no locks are held meanwhile: hooks may query or
+change the process list themselves. HookFuncs spares the need to implement them
+all, and NewAsyncHooks() wraps them to run from a separate routine instead,
+dropping (and counting) events if they fall behind:
+
+	hooks := pm.NewAsyncHooks(pm.HookFuncs{
+		Done: func(ev pm.Event) {
+			log.Printf("task %s %s", ev.Id, ev.Outcome)
+		},
+	}, 1024)
+	remove := pm.AddHooks(hooks)
+
+For a durable record, surviving crashes, events may be written to a Journal set
+with SetJournal(). That's a file (rotated according to JournalOpts) with an
+Event per line, encoded as JSON. ReadJournal() rebuilds the tasks out of it,
+with their history and attributes, telling those that never ended:
+
+	j, err := pm.OpenJournal("/var/log/app/pm.journal", pm.JournalOpts{
+		MaxSize:  64 << 20,
+		MaxFiles: 4,
+	})
+	if err == nil {
+		pm.SetJournal(j)
+	}
+
+By default, anyone able to reach the HTTP port may list tasks and cancel them.
+Access can be restricted by setting an Authorizer with SetAuthorizer(). Clients
+are then required to hold the PermRead permission to retrieve information, and
+PermWrite to cancel tasks. The package includes authorizers for static bearer
+tokens (TokenAuthorizer) and for HMAC-signed requests (HMACAuthorizer, see
+SignRequest()), but any implementation of the interface will do. Refused
+cancellation requests are reported as events, and recorded in the history of
+the task targeted, if running (only once, with a count of further attempts).
+
+Metrics derived from the process list are available in the Prometheus text
+format at /metrics, including the number of running tasks by status, counters
+of finished tasks by outcome, and histograms for the duration of tasks and the
+time spent in each status (up to MaxMetricsStatuses of them, with the rest
+accounted as OtherStatus). Running tasks may be labelled by some of their
+attributes too, as long as they are listed in the MetricsAttrs option. (Keep
+in mind that every distinct value yields a separate time series.)
+
+Tasks may be given a time budget with the Timeout option, either for a given
+task or as a default for the whole process list. A task still running when its
+deadline expires is marked as cancel-pending, exactly as if Kill() had been
+called with DeadlineExceeded as the message. (Unless cancellation is forbidden
+for the task, that is.) The deadline and the remaining time for the task are
+reported to HTTP clients as well.
+
+Tasks that stop changing their status are often the ones most worth a look.
+Setting the StallThreshold option, pm will flag tasks as stalled when their
+history doesn't change for that long. Stalled tasks are reported as such to
+HTTP clients and through a "stalled" event. The process list may be set to call
+a StallHandler function and/or to request cancellation of stalled tasks (with
+the KillStalled option). Tasks are no longer stalled as soon as their history
+changes again.
+
+Setting the ProfileLabels option, goroutines running tasks are tagged with pprof
+labels while the task runs: LabelTaskId holds the task identifier, and the
+attributes listed in the ProfileAttrs option are added as well (as available
+when the task was started). CPU and goroutine profiles can then be sliced by
+task or attribute. Goroutines started by the task inherit the labels. Clients
+may also GET /procs/<id>/stack to retrieve the stack traces for the goroutines
+carrying the label for a given task, to find out where it is blocked (a 501
+reply means that the ProfileLabels option is not set). Labels are restored to
+those in the context given when the task was started (or none at all) when the
+task is Done().
+
+Tasks are normally forgotten as soon as they're Done(). Applications willing to
+inspect recently finished tasks (think of a post-mortem for a slow request that
+just ended) can have pm retain them, setting the DoneMaxCount and/or DoneMaxAge
+options for the process list. Retained tasks are listed by a GET to /procs/done,
+with their final status, and their full history is still available through
+/procs/<id>/history.
+
+Passing identifiers around may be avoided by using StartTask() instead, that
+returns a *Task handle with methods equivalent to the functions above:
+
+	task := pm.StartTask(req.Context(), requestID, nil, nil)
+	defer task.Done()
+	task.Status("querying")
+	rows, err := db.QueryContext(task.Context(), query)
+
+Besides being cheaper, calls through the handle always affect the right task,
+even if some other task happens to reuse the identifier.
+
+Structured logs may be correlated with tasks too. Task.Logger() returns an
+*slog.Logger tagging records with the task identifier (under the LabelTaskId
+key). Records go to the LogHandler option, or slog's default handler if unset.
+If the LogHistory option is set, those at or above the LogHistoryLevel option
+are added to the task's history as well. Loggers built on NewLogHandler() get
+the same tag, plus any attributes chosen, from the task context passed to them:
+
+	logger := slog.New(pm.NewLogHandler(slog.Default().Handler(), "host"))
+	logger.InfoContext(task.Context(), "query done", "rows", n)
+
+Long-running tasks may report their progress with Progress(), giving the amount
+of work done, the total expected and a unit for them. Progress is included in
+the task details, together with the rate and the estimated completion time,
+computed by the server. Tasks may be sorted by progress (percent done) or eta in
+/procs/ queries:
+
+	for i, row := range rows {
+		task.Progress(int64(i), int64(len(rows)), "rows")
+		...
+	}
+
+Tasks may also keep a log of free-form lines, apart from their history, by
+calling Logf() (or the Task method of the same name). Only the most recent lines
+are kept, as set by the LogMaxLines option. The log is served by a GET to
+/procs/<id>/log, that streams new lines as Server-Sent Events until the task is
+done if the follow=true query parameter is given, much like "tail -f".
+
+Note that Start() replaces a running task if its identifier is reused, so that
+only the new one is listed. Done() calls for that identifier finish the tasks
+replaced first, oldest to newest, so that a stale Done() never finishes the new
+task (a handle's Done() always finishes its own task). StartE() and StartTaskE()
+fail with ErrDuplicateId in such a case instead. Alternatively, an empty
+identifier may be given to StartTask() and StartTaskE() to have a unique one
+generated, available from the handle's Id().
+Every task is also assigned a generation number, unique for the process list,
+that's reported to HTTP clients. Cancellation requests through HTTP may include
+it, so that they are ignored if the identifier got reused in the meantime.
+
 Finally, please note that cancellation requests yield panics in the same routine
 that called Start() with that given identifier. However, it's not unusual for
-servers to spawn additional Go routines to handle the same request. The
-application is responsible of cleaning up, if there are additional resources
-that should be recycled. The proper way to do this is by catching CancelErr type
-panics, cleaning-up and then re-panic, i.e.:
+servers to spawn additional Go routines to handle the same request. Such
+routines may be tracked as tasks on their own, declaring the original one as
+their parent with the Parent option:
+
+	pm.Start(workerID, &pm.ProcOpts{Parent: requestID}, nil)
+	defer pm.Done(workerID)
+
+Options having nothing but the Parent set keep the defaults for the process
+list, as if no options were given; otherwise (even if empty), the options
+provided are used as they are.
+
+Tasks thus form a tree. A cancellation request for a task is propagated to all
+of its descendants, and clients can GET /procs/<id>/children to retrieve the
+whole subtree below a given task. Otherwise, the application is responsible of
+cleaning up, if there are additional resources that should be recycled. The
+proper way to do this is by catching CancelErr type panics, cleaning-up and then
+re-panic, i.e.:
 
 	func handleRequest(requestId string) {
 		pm.Start(requestId, map[string]interface{}{})
@@ -130,8 +368,12 @@ package pm
 
 import (
 	"container/list"
+	"context"
 	"errors"
+	"log/slog"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -141,47 +383,126 @@ import (
 // Proclist object (DefaultProclist) and package-level functions. The zero value
 // for the type is a Proclist ready to be used.
 type Proclist struct {
-	mu    sync.RWMutex
-	procs map[string]*proc
-	opts  ProclistOpts
+	mu       sync.RWMutex
+	procs    map[string]*proc
+	replaced map[string][]*proc
+	gen      uint64
+	doneList list.List
+	opts     ProclistOpts
+	subs     subscribers
+	auth     Authorizer
+	metrics  metrics
+	drain    drainState
+	denied   atomic.Int64 // Time of the last denial reported for no task
 }
 
 // Type ProclistOpts provides all options to be set for a Proclist. Options
-// shared with ProcOpts act as defaults in case no options are provided in a
-// task's call to Start().
+// shared with ProcOpts act as defaults in case no options (or only the Parent)
+// are provided in a task's call to Start().
 type ProclistOpts struct {
-	StopCancelPanic bool // Stop cancel-related panics at Done()
-	ForbidCancel    bool // Forbid cancellation requests
+	StopCancelPanic bool             // Stop cancel-related panics at Done()
+	StopAbortPanic  bool             // Stop any other panics at Done()
+	AbortHandler    AbortFunc        // Called for panics aborting tasks
+	ForbidCancel    bool             // Forbid cancellation requests
+	DoneMaxCount    int              // Max number of finished tasks to retain
+	DoneMaxAge      time.Duration    // Max time to retain finished tasks
+	MetricsAttrs    []string         // Attributes used as labels in metrics
+	Timeout         time.Duration    // Time budget for tasks (0 for no limit)
+	StallThreshold  time.Duration    // Inactivity time to flag tasks as stalled
+	KillStalled     bool             // Request cancellation of stalled tasks
+	StallHandler    func(ProcDetail) // Called for tasks flagged as stalled
+	ProfileLabels   bool             // Set pprof labels for tasks' goroutines
+	ProfileAttrs    []string         // Attributes included in pprof labels
+	CancelMode      CancelMode       // How cancellation points report cancellation
+	LogHandler      slog.Handler     // Handler for task loggers (slog's default if nil)
+	LogHistory      bool             // Add task log records to history
+	LogHistoryLevel slog.Level       // Min level of task log records added to history
+	LogMaxLines     int              // Max lines kept in task logs (0 for default)
 }
 
+// Type AbortFunc is a handler for panics aborting tasks (other than those due to
+// cancellation), receiving the task identifier and the panic value.
+type AbortFunc func(id string, e interface{})
+
 // Type ProcOpts provides options for the process.
 type ProcOpts struct {
-	StopCancelPanic bool // Stop cancel-related panics at Done()
-	ForbidCancel    bool // Forbid cancellation requests
+	StopCancelPanic bool          // Stop cancel-related panics at Done()
+	StopAbortPanic  bool          // Stop any other panics at Done()
+	ForbidCancel    bool          // Forbid cancellation requests
+	Parent          string        // Identifier of the parent task, if any
+	Timeout         time.Duration // Time budget for the task (0 for no limit)
+	StallThreshold  time.Duration // Inactivity time to flag the task as stalled
+	CancelMode      CancelMode    // How cancellation points report cancellation
+	LogMaxLines     int           // Max lines kept in the task log (0 for default)
 }
 
+// Type CancelMode selects how cancellation points (like Status() and
+// CheckCancel()) behave when a cancellation request is pending.
+type CancelMode int
+
+const (
+	CancelPanic CancelMode = iota // Panic with a CancelErr
+	CancelError                   // Don't panic; only the E variants report it
+)
+
 type proc struct {
 	mu      sync.RWMutex
+	pl      *Proclist
 	id      string
+	gen     uint64
 	attrs   map[string]interface{}
 	history list.List
 	cancel  struct {
 		isPending bool
 		message   string
+		reported  bool
 	}
-	opts ProcOpts
+	opts      ProcOpts
+	cancelCtx context.CancelCauseFunc
+	deadline  time.Time
+	timer     *time.Timer
+	stall     *time.Timer
+	stalled   bool
+	active    time.Time
+	denials   int
+	denied    *historyEntry
+	ended     time.Time
+	labelsCtx context.Context
+	logBuf    logBuffer
+	progress  progressState
+
+	// Links in the task hierarchy, protected by the Proclist's lock
+	parent   *proc
+	children map[*proc]struct{}
+
+	// Set once Done() is called, protected by the Proclist's lock
+	finished bool
 }
 
 type historyEntry struct {
 	ts     time.Time
 	status string
+	panic  *PanicDetail
 }
 
 var (
 	ErrForbidden     = errors.New("forbidden")
 	ErrNoSuchProcess = errors.New("no such process")
+	ErrDuplicateId   = errors.New("duplicate task id")
+	ErrDraining      = errors.New("process list draining")
+
+	// Internal to kill(), for processes already finished
+	errEnded = errors.New("process ended")
 )
 
+// DeadlineExceeded is the cancellation message for tasks that outlive the
+// budget set by the Timeout option.
+const DeadlineExceeded = "deadline exceeded"
+
+// Stalled is the cancellation message for stalled tasks, when the KillStalled
+// option is set.
+const Stalled = "stalled"
+
 // Options returns the options set for this Proclist.
 func (pl *Proclist) Options() ProclistOpts {
 	pl.mu.RLock()
@@ -204,13 +525,56 @@ func (pl *Proclist) SetOptions(opts ProclistOpts) {
 // are not provided (nil), Start() will snapshot the global options for the
 // process list set by SetOptions().
 func (pl *Proclist) Start(id string, opts *ProcOpts, attrs *map[string]interface{}) {
-	if opts == nil {
+	p := pl.newProc(id, opts, attrs)
+	if pl.add(p, false) == nil {
+		pl.setLabels(context.Background(), p)
+	}
+}
+
+// StartE works like Start(), but fails with ErrDuplicateId if the identifier is
+// in use by a running task, instead of replacing it, or with ErrDraining if the
+// process list is being drained.
+func (pl *Proclist) StartE(id string, opts *ProcOpts, attrs *map[string]interface{}) error {
+	p := pl.newProc(id, opts, attrs)
+	if err := pl.add(p, true); err != nil {
+		return err
+	}
+	pl.setLabels(context.Background(), p)
+	return nil
+}
+
+// StartContext works like Start(), but also returns a context derived from ctx
+// that is canceled as soon as a cancellation request is received for the task,
+// or when the task is Done(). Upon a Kill(), context.Cause() on the returned
+// context yields the same CancelErr that would be used for a panic at the next
+// cancellation point.
+func (pl *Proclist) StartContext(ctx context.Context, id string, opts *ProcOpts,
+	attrs *map[string]interface{}) context.Context {
+
+	return pl.StartTask(ctx, id, opts, attrs).Context()
+}
+
+// newProc creates a process object for a task, ready to be added to the list.
+func (pl *Proclist) newProc(id string, opts *ProcOpts, attrs *map[string]interface{}) *proc {
+	if opts == nil || (opts.Parent != "" && *opts == ProcOpts{Parent: opts.Parent}) {
+		var parent string
+		if opts != nil {
+			parent = opts.Parent
+		}
+		plOpts := pl.Options()
 		opts = &ProcOpts{
-			StopCancelPanic: pl.opts.StopCancelPanic,
-			ForbidCancel:    pl.opts.ForbidCancel,
+			Parent:          parent,
+			StopCancelPanic: plOpts.StopCancelPanic,
+			StopAbortPanic:  plOpts.StopAbortPanic,
+			ForbidCancel:    plOpts.ForbidCancel,
+			Timeout:         plOpts.Timeout,
+			StallThreshold:  plOpts.StallThreshold,
+			CancelMode:      plOpts.CancelMode,
+			LogMaxLines:     plOpts.LogMaxLines,
 		}
 	}
 	p := &proc{
+		pl:   pl,
 		id:   id,
 		opts: *opts,
 	}
@@ -219,45 +583,155 @@ func (pl *Proclist) Start(id string, opts *ProcOpts, attrs *map[string]interface
 	} else {
 		p.attrs = make(map[string]interface{})
 	}
-	p.addHistoryEntry(time.Now(), "init")
+	ts := time.Now()
+	p.addHistoryEntry(ts, "init")
+	if opts.Timeout > 0 {
+		p.deadline = ts.Add(opts.Timeout)
+	}
+	return p
+}
 
+// add registers a process in the list, so that it's visible to clients. The
+// process is linked to its parent, if one was set in the options and is still
+// running. If unique is set, ErrDuplicateId is returned for an identifier
+// already in use; otherwise the new process replaces the old one. Processes
+// with an empty identifier get one generated. While draining, processes are
+// rejected with ErrDraining. Rejected processes are left untracked, with no
+// generation number.
+func (pl *Proclist) add(p *proc, unique bool) error {
 	pl.mu.Lock()
+	if pl.drain.draining {
+		pl.mu.Unlock()
+		return ErrDraining
+	}
 	if pl.procs == nil {
 		pl.procs = make(map[string]*proc)
 	}
-	pl.procs[id] = p
+	old, present := pl.procs[p.id]
+	if present && unique && p.id != "" {
+		pl.mu.Unlock()
+		return ErrDuplicateId
+	}
+	if present && p.id != "" {
+		// Keep track of the replaced process, so that it's finished first
+		if pl.replaced == nil {
+			pl.replaced = make(map[string][]*proc)
+		}
+		pl.replaced[p.id] = append(pl.replaced[p.id], old)
+	}
+	pl.gen++
+	p.gen = pl.gen
+	if p.id == "" {
+		for p.id = "task-" + strconv.FormatUint(p.gen, 10); pl.procs[p.id] != nil; {
+			p.id += "_"
+		}
+	}
+	pl.procs[p.id] = p
+	if parent, present := pl.procs[p.opts.Parent]; present && p.opts.Parent != p.id {
+		p.parent = parent
+		if parent.children == nil {
+			parent.children = make(map[*proc]struct{})
+		}
+		parent.children[p] = struct{}{}
+	}
+
+	p.mu.Lock()
+	if !p.deadline.IsZero() {
+		p.timer = time.AfterFunc(time.Until(p.deadline), func() {
+			pl.kill(p, time.Now(), DeadlineExceeded)
+		})
+	}
+	if p.opts.StallThreshold > 0 {
+		p.stall = time.AfterFunc(p.opts.StallThreshold, func() {
+			pl.checkStalled(p)
+		})
+	}
+	subscribed := pl.subscribed()
+	var ev Event
+	if subscribed {
+		attrs := make(map[string]interface{})
+		for name, value := range p.attrs {
+			attrs[name] = value
+		}
+		first := p.history.Front().Value.(*historyEntry)
+		ev = p.event(EventStart, first.ts, first.status, attrs)
+	}
+	p.mu.Unlock()
 	pl.mu.Unlock()
+
+	// Sent without holding locks, so that hooks may call back into the list
+	if subscribed {
+		pl.emit(ev)
+	}
+	return nil
+}
+
+// lookup returns the running process with the given identifier.
+func (pl *Proclist) lookup(id string) (*proc, bool) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	p, present := pl.procs[id]
+	return p, present
+}
+
+// unlink removes a process from the task hierarchy, assuming the Proclist's
+// lock is already held. Children of the process are left without a parent,
+// although they keep reporting the parent's identifier.
+func (p *proc) unlink() {
+	if p.parent != nil {
+		delete(p.parent.children, p)
+		p.parent = nil
+	}
+	for child := range p.children {
+		child.parent = nil
+	}
+	p.children = nil
+}
+
+// descendants returns all processes in the subtree rooted at p, excluding p
+// itself, assuming the Proclist's lock is already held.
+func (p *proc) descendants() []*proc {
+	var procs []*proc
+	for child := range p.children {
+		procs = append(procs, child)
+		procs = append(procs, child.descendants()...)
+	}
+	return procs
 }
 
 // SetAttribute sets an application-specific attribute for the task given by id.
 // Unrecognized identifiers are silently skipped. Duplicate attribute names for
 // the task overwrite the previously set value.
 func (pl *Proclist) SetAttribute(id, name string, value interface{}) {
-	pl.mu.RLock()
-	p, present := pl.procs[id]
-	pl.mu.RUnlock()
-
-	if present {
-		p.mu.Lock()
-		defer p.mu.Unlock()
-		p.attrs[name] = value
+	if p, present := pl.lookup(id); present {
+		p.setAttribute(name, value)
 	}
 }
 
+func (p *proc) setAttribute(name string, value interface{}) {
+	p.mu.Lock()
+	p.attrs[name] = value
+	ev := p.newEvent(EventAttribute, time.Now(), "", map[string]interface{}{name: value})
+	p.mu.Unlock()
+	p.pl.send(ev)
+}
+
 // DelAttribute deletes an attribute for the task given by id. Unrecognized
 // task identifiers are silently skipped.
 func (pl *Proclist) DelAttribute(id, name string) {
-	pl.mu.RLock()
-	p, present := pl.procs[id]
-	pl.mu.RUnlock()
-
-	if present {
-		p.mu.Lock()
-		defer p.mu.Unlock()
-		delete(p.attrs, name)
+	if p, present := pl.lookup(id); present {
+		p.delAttribute(name)
 	}
 }
 
+func (p *proc) delAttribute(name string) {
+	p.mu.Lock()
+	delete(p.attrs, name)
+	ev := p.newEvent(EventAttribute, time.Now(), "", map[string]interface{}{name: nil})
+	p.mu.Unlock()
+	p.pl.send(ev)
+}
+
 // Type CancelErr is the type used for cancellation-induced panics.
 type CancelErr string
 
@@ -266,80 +740,205 @@ func (e CancelErr) Error() string {
 	return string(e)
 }
 
-func (p *proc) doCancel() {
+// cancelErr returns the error to be used when canceling the process, assuming
+// the lock is already held.
+func (p *proc) cancelErr() CancelErr {
 	message := "killed"
 	if len(p.cancel.message) > 0 {
 		message += ": " + p.cancel.message
 	}
+	return CancelErr(message)
+}
+
+// pendingCancel returns the error for a pending cancellation request, if any,
+// assuming the lock is already held. If report is set, the cancellation is
+// considered as reported to the task, so that it's recorded as killed when
+// done.
+func (p *proc) pendingCancel(report bool) error {
+	if !p.cancel.isPending {
+		return nil
+	}
+	if report {
+		p.cancel.reported = true
+	}
+	return p.cancelErr()
+}
 
-	panic(CancelErr(message))
+// cancelPoint panics with err if it's a cancellation error and the options for
+// the process call for panics.
+func (p *proc) cancelPoint(err error) {
+	if err != nil && p.opts.CancelMode == CancelPanic {
+		panic(err)
+	}
 }
 
 // addHistoryEntry pushes a new entry to the processes' history, assuming the
-// lock is already held.
+// lock is already held. The entry counts as activity for the stall watchdog.
 func (p *proc) addHistoryEntry(ts time.Time, status string) {
+	p.addHistoryMarker(ts, status)
+	p.active = ts
+	if p.stall != nil {
+		p.stall.Reset(p.opts.StallThreshold)
+		p.stalled = false
+	}
+}
+
+// addHistoryMarker pushes a new entry to the processes' history, assuming the
+// lock is already held. Markers note changes not coming from the task itself
+// (like cancellation requests), so they leave the stall watchdog alone.
+func (p *proc) addHistoryMarker(ts time.Time, status string) {
 	p.history.PushBack(&historyEntry{
 		ts:     ts,
 		status: status,
 	})
 }
 
+// checkStalled flags the process as stalled if its history hasn't changed (but
+// for markers) for the time set by the StallThreshold option. The StallHandler,
+// if any, is called and cancellation is requested if the KillStalled option is
+// set.
+func (pl *Proclist) checkStalled(p *proc) {
+	ts := time.Now()
+	p.mu.Lock()
+	last := p.history.Back().Value.(*historyEntry)
+	if !p.ended.IsZero() || p.stalled || ts.Sub(p.active) < p.opts.StallThreshold {
+		p.mu.Unlock()
+		return
+	}
+	p.stalled = true
+	ev := p.newEvent(EventStalled, ts, last.status, nil)
+	detail := p.detail()
+	p.mu.Unlock()
+	pl.send(ev)
+
+	opts := pl.Options()
+	if opts.StallHandler != nil {
+		opts.StallHandler(detail)
+	}
+	if opts.KillStalled {
+		pl.kill(p, ts, Stalled)
+	}
+}
+
 // Status changes the status for a task in a Proclist, adding an item to the
 // task's history. Note that Status() is a cancellation point, thus the routine
-// calling it is subject to a panic due to a pending Kill().
+// calling it is subject to a panic due to a pending Kill(), unless the task's
+// CancelMode is CancelError.
 func (pl *Proclist) Status(id, status string) {
 	ts := time.Now()
-	pl.mu.RLock()
-	p, present := pl.procs[id]
-	pl.mu.RUnlock()
-
-	if present {
-		p.mu.Lock()
-		defer p.mu.Unlock()
-		p.addHistoryEntry(ts, status)
+	if p, present := pl.lookup(id); present {
+		p.cancelPoint(p.setStatus(ts, status, false))
+	}
+}
 
-		if p.cancel.isPending {
-			p.doCancel()
-		}
+// StatusE works like Status(), but never panics. A pending cancellation is
+// returned as a CancelErr instead. Unrecognized identifiers are silently
+// skipped.
+func (pl *Proclist) StatusE(id, status string) error {
+	ts := time.Now()
+	if p, present := pl.lookup(id); present {
+		return p.setStatus(ts, status, true)
 	}
+	return nil
+}
+
+func (p *proc) setStatus(ts time.Time, status string, report bool) error {
+	p.mu.Lock()
+	p.addHistoryEntry(ts, status)
+	ev := p.newEvent(EventStatus, ts, status, nil)
+	err := p.pendingCancel(report)
+	p.mu.Unlock()
+	p.pl.send(ev)
+	return err
 }
 
 // CheckCancel introduces a cancellation point just like Status() does, but
 // without changing the task status, nor adding an entry to history.
 func (pl *Proclist) CheckCancel(id string) {
-	pl.mu.RLock()
-	p, present := pl.procs[id]
-	pl.mu.RUnlock()
-
-	if present {
-		p.mu.Lock()
-		defer p.mu.Unlock()
+	if p, present := pl.lookup(id); present {
+		p.cancelPoint(p.checkCancel(false))
+	}
+}
 
-		if p.cancel.isPending {
-			p.doCancel()
-		}
+// CheckCancelE works like CheckCancel(), but never panics. A pending
+// cancellation is returned as a CancelErr instead.
+func (pl *Proclist) CheckCancelE(id string) error {
+	if p, present := pl.lookup(id); present {
+		return p.checkCancel(true)
 	}
+	return nil
+}
+
+func (p *proc) checkCancel(report bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pendingCancel(report)
 }
 
 // Kill sets a cancellation request to the task with the given identifier, that
 // will be effective as soon as the routine running that task hits a
 // cancellation point. The (optional) message will be included in the CancelErr
-// object used for panic.
+// object used for panic. All descendants of the task are marked for
+// cancellation as well, except for those having the ForbidCancel option set.
+// That's even if the task itself has it set, and ErrForbidden is returned.
 func (pl *Proclist) Kill(id, message string) error {
 	ts := time.Now()
+	p, present := pl.lookup(id)
+	if !present {
+		return ErrNoSuchProcess
+	}
+	return pl.kill(p, ts, message)
+}
+
+// kill marks a process and all of its descendants as cancel-pending. The error
+// returned is that for the process itself; descendants are marked regardless.
+func (pl *Proclist) kill(p *proc, ts time.Time, message string) error {
+	_, _, err := pl.killTree(p, ts, message)
+	return err
+}
+
+// killTree works like kill(), but also returns the processes (the given one
+// and its descendants) marked as cancel-pending, and those refused because of
+// the ForbidCancel option. Processes already finished are in neither.
+func (pl *Proclist) killTree(p *proc, ts time.Time, message string) (marked, forbidden []*proc, err error) {
 	pl.mu.RLock()
-	p, present := pl.procs[id]
+	descendants := p.descendants()
 	pl.mu.RUnlock()
 
-	if !present {
-		return ErrNoSuchProcess
+	for i, q := range append([]*proc{p}, descendants...) {
+		switch qerr := q.requestCancel(ts, message); qerr {
+		case nil:
+			marked = append(marked, q)
+		case ErrForbidden:
+			forbidden = append(forbidden, q)
+			if i == 0 {
+				err = qerr
+			}
+		}
 	}
+	return marked, forbidden, err
+}
+
+// requestCancel marks the process as cancel-pending, unless it was already.
+// Requests for processes already finished are ignored, returning errEnded.
+func (p *proc) requestCancel(ts time.Time, message string) error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	ev, err := p.setCancelPending(ts, message)
+	p.mu.Unlock()
+	p.pl.send(ev)
+	return err
+}
 
+// setCancelPending does the work for requestCancel(), assuming the lock is
+// already held. It returns the event to be sent, if any.
+func (p *proc) setCancelPending(ts time.Time, message string) (*Event, error) {
+	if !p.ended.IsZero() {
+		return nil, errEnded
+	}
 	if p.opts.ForbidCancel {
-		return ErrForbidden
+		return nil, ErrForbidden
 	}
+	var ev *Event
 	if !p.cancel.isPending {
 		p.cancel.isPending = true
 		p.cancel.message = message
@@ -350,48 +949,136 @@ func (pl *Proclist) Kill(id, message string) error {
 		} else {
 			hentry = "[cancel request]"
 		}
-		p.addHistoryEntry(ts, hentry)
+		p.addHistoryMarker(ts, hentry)
+		ev = p.newEvent(EventCancelRequest, ts, hentry, nil)
+
+		if p.cancelCtx != nil {
+			p.cancelCtx(p.cancelErr())
+		}
 	}
-	return nil
+	return ev, nil
 }
 
 // done marks the end of a process, registering it depending on the outcome.
 // Parameter e is supposed to be the result of recover(), so that we know
 // whether processing ended normally, was canceled or aborted due to any other
-// panic.
+// panic. Processes replaced by others with the same identifier go first.
 func (pl *Proclist) done(id string, e interface{}) {
+	pl.mu.RLock()
+	p := pl.procs[id]
+	if replaced := pl.replaced[id]; len(replaced) > 0 {
+		p = replaced[0]
+	}
+	pl.mu.RUnlock()
+	pl.doneProc(id, p, e)
+}
+
+// doneProc works like done(), given the process as well as its identifier. A
+// nil process stands for an unknown one. Processes already finished (as in the
+// case of a duplicate Done() call) or never tracked are only checked for
+// panics, as per the list options. Either way, aborts are always reported to
+// the AbortHandler first, and then propagated unless stopped.
+func (pl *Proclist) doneProc(id string, p *proc, e interface{}) {
 	pl.mu.Lock()
-	p, present := pl.procs[id]
-	if present {
-		delete(pl.procs, id)
+	live := p != nil && p.gen != 0 && !p.finished
+	if live {
+		// Processes replaced by another one with the same identifier are no
+		// longer in the map, but they still need to be finished
+		p.finished = true
+		if pl.procs[p.id] == p {
+			delete(pl.procs, p.id)
+			pl.checkDrained()
+		} else {
+			pl.forgetReplaced(p)
+		}
+		p.unlink()
 	}
-	stopPanic := pl.opts.StopCancelPanic
+	stopPanic, stopAbort := pl.opts.StopCancelPanic, pl.opts.StopAbortPanic
+	abortHandler := pl.opts.AbortHandler
 	pl.mu.Unlock()
 
-	if present {
-		ts := time.Now()
-		p.mu.Lock()
-		defer p.mu.Unlock()
+	_, canceled := e.(CancelErr)
+	if !live {
+		if e != nil && !canceled && abortHandler != nil {
+			abortHandler(id, e)
+		}
+		if e != nil && (canceled && !stopPanic || !canceled && !stopAbort) {
+			panic(e)
+		}
+		return
+	}
 
-		if e != nil {
-			if msg, canceled := e.(CancelErr); canceled {
-				p.addHistoryEntry(ts, string(msg))
-				if !p.opts.StopCancelPanic {
-					panic(e)
-				}
-			} else {
-				p.addHistoryEntry(ts, "aborted")
-				panic(e)
-			}
-		} else {
-			p.addHistoryEntry(ts, "ended")
+	ts := time.Now()
+	ev, repanic := p.finish(ts, e)
+	p.restoreLabels()
+	pl.retain(p)
+	pl.send(ev)
+	if e != nil && !canceled && abortHandler != nil {
+		abortHandler(p.id, e)
+	}
+	if repanic {
+		panic(e)
+	}
+}
+
+// forgetReplaced removes a process from those replaced by another one with the
+// same identifier, assuming the Proclist's lock is already held.
+func (pl *Proclist) forgetReplaced(p *proc) {
+	replaced := pl.replaced[p.id]
+	for i, r := range replaced {
+		if r == p {
+			replaced = append(replaced[:i:i], replaced[i+1:]...)
+			break
 		}
+	}
+	if len(replaced) == 0 {
+		delete(pl.replaced, p.id)
+	} else {
+		pl.replaced[p.id] = replaced
+	}
+}
+
+// finish records the outcome of a process in its history, as per the result e
+// of recover(). It returns the event to be sent once the process is retained,
+// if any, and whether the panic, if any, should be propagated.
+func (p *proc) finish(ts time.Time, e interface{}) (*Event, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancelCtx != nil {
+		p.cancelCtx(nil)
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if p.stall != nil {
+		p.stall.Stop()
+		p.stall = nil
+	}
+	p.ended = ts
+	p.wakeLogFollowers()
+
+	status, outcome, repanic := "ended", "ended", false
+	var panicDetail *PanicDetail
+	if e == nil && p.cancel.reported {
+		status, outcome = string(p.cancelErr()), "killed"
 	} else if e != nil {
-		_, canceled := e.(CancelErr)
-		if !canceled || !stopPanic {
-			panic(e)
+		if msg, canceled := e.(CancelErr); canceled {
+			status, outcome, repanic = string(msg), "killed", !p.opts.StopCancelPanic
+		} else {
+			status, outcome, repanic = "aborted", "aborted", !p.opts.StopAbortPanic
+			panicDetail = newPanicDetail(e)
 		}
 	}
+	p.addHistoryEntry(ts, status)
+	p.history.Back().Value.(*historyEntry).panic = panicDetail
+	ev := p.newEvent(EventDone, ts, status, nil)
+	if ev != nil {
+		ev.Outcome = outcome
+		ev.Panic = panicDetail
+	}
+	p.pl.metrics.observe(p, outcome)
+	return ev, repanic
 }
 
 // Done marks the end of a task, writing in history depending on the outcome
@@ -399,7 +1086,7 @@ func (pl *Proclist) done(id string, e interface{}) {
 // resources associated with the process, thus making the id available for use
 // by another task. It also stops panics raising from cancellation requests, but
 // only when the StopCancelPanic option is set AND Done is called with a defer
-// statement.
+// statement. Other panics are stopped as well if StopAbortPanic is set.
 func (pl *Proclist) Done(id string) {
 	pl.done(id, recover())
 }
@@ -429,6 +1116,24 @@ func Start(id string, opts *ProcOpts, attrs *map[string]interface{}) {
 	DefaultProclist.Start(id, opts, attrs)
 }
 
+// StartE works like Start(), but fails with ErrDuplicateId if the identifier is
+// in use by a running task, instead of replacing it, or with ErrDraining if the
+// process list is being drained.
+func StartE(id string, opts *ProcOpts, attrs *map[string]interface{}) error {
+	return DefaultProclist.StartE(id, opts, attrs)
+}
+
+// StartContext works like Start(), but also returns a context derived from ctx
+// that is canceled as soon as a cancellation request is received for the task,
+// or when the task is Done(). Upon a Kill(), context.Cause() on the returned
+// context yields the same CancelErr that would be used for a panic at the next
+// cancellation point.
+func StartContext(ctx context.Context, id string, opts *ProcOpts,
+	attrs *map[string]interface{}) context.Context {
+
+	return DefaultProclist.StartContext(ctx, id, opts, attrs)
+}
+
 // SetAttribute sets an application-specific attribute for the task given by id.
 // Unrecognized identifiers are silently skipped. Duplicate attribute names for
 // the task overwrite the previously set value.
@@ -444,21 +1149,36 @@ func DelAttribute(id, name string) {
 
 // Status changes the status for a task in the default Proclist, adding an item
 // to the task's history. Note that Status() is a cancellation point, thus the
-// routine calling it is subject to a panic due to a pending Kill().
+// routine calling it is subject to a panic due to a pending Kill(), unless the
+// task's CancelMode is CancelError.
 func Status(id, status string) {
 	DefaultProclist.Status(id, status)
 }
 
+// StatusE works like Status(), but never panics. A pending cancellation is
+// returned as a CancelErr instead. Unrecognized identifiers are silently
+// skipped.
+func StatusE(id, status string) error {
+	return DefaultProclist.StatusE(id, status)
+}
+
 // CheckCancel introduces a cancellation point just like Status() does, but
 // without changing the task status, nor adding an entry to history.
 func CheckCancel(id string) {
 	DefaultProclist.CheckCancel(id)
 }
 
+// CheckCancelE works like CheckCancel(), but never panics. A pending
+// cancellation is returned as a CancelErr instead.
+func CheckCancelE(id string) error {
+	return DefaultProclist.CheckCancelE(id)
+}
+
 // Kill sets a cancellation request to the task with the given identifier, that
 // will be effective as soon as the routine running that task hits a
 // cancellation point. The (optional) message will be included in the CancelErr
-// object used for panic.
+// object used for panic. All descendants of the task are marked for
+// cancellation as well, except for those having the ForbidCancel option set.
 func Kill(id, message string) error {
 	return DefaultProclist.Kill(id, message)
 }
@@ -468,7 +1188,7 @@ func Kill(id, message string) error {
 // resources associated with the process, thus making the id available for use
 // by another task. It also stops panics raising from cancellation requests, but
 // only when the StopCancelPanic option is set AND Done is called with a defer
-// statement.
+// statement. Other panics are stopped as well if StopAbortPanic is set.
 func Done(id string) {
 	DefaultProclist.done(id, recover())
 }
@@ -3,11 +3,28 @@
 package pm
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -169,6 +186,1676 @@ func TestProclist(t *testing.T) {
 	}
 }
 
+func TestStartContext(t *testing.T) {
+	var pl Proclist
+	ctx := pl.StartContext(context.Background(), "req1", nil, nil)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context canceled before Kill()")
+	default:
+	}
+
+	if err := pl.Kill("req1", "my message"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled after Kill()")
+	}
+	if cause := context.Cause(ctx); cause != CancelErr("killed: my message") {
+		t.Errorf("bad cancel cause: %v", cause)
+	}
+
+	ctx = pl.StartContext(context.Background(), "req2", &ProcOpts{ForbidCancel: true}, nil)
+	if err := pl.Kill("req2", ""); err != ErrForbidden {
+		t.Errorf("expected ErrForbidden, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("context canceled for task with ForbidCancel")
+	}
+	pl.Done("req2")
+	if context.Cause(ctx) != context.Canceled {
+		t.Error("context not canceled at Done()")
+	}
+}
+
+func TestDoneRetention(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{StopCancelPanic: true, DoneMaxCount: 2})
+
+	for _, id := range []string{"req1", "req2", "req3"} {
+		func() {
+			pl.Start(id, nil, nil)
+			defer pl.Done(id)
+			pl.Status(id, "working")
+			if id == "req3" {
+				pl.Kill(id, "")
+				pl.CheckCancel(id)
+			}
+		}()
+	}
+
+	done := pl.getDoneProcs()
+	if len(done) != 2 {
+		t.Fatalf("len(done) = %d; expecting 2", len(done))
+	}
+	if done[0].Id != "req3" || done[0].Status != "killed" {
+		t.Errorf("bad first done task: %s (%s)", done[0].Id, done[0].Status)
+	}
+	if done[1].Id != "req2" || done[1].Status != "ended" {
+		t.Errorf("bad second done task: %s (%s)", done[1].Id, done[1].Status)
+	}
+
+	w := httptest.NewRecorder()
+	pl.handleProcsReq(w, httptest.NewRequest("GET", "/procs/req2/history", nil))
+	var history HistoryResponse
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	checkHistoryResponse(t, &history, &HistoryResponse{
+		History: []HistoryDetail{
+			HistoryDetail{Status: "init"},
+			HistoryDetail{Status: "working"},
+			HistoryDetail{Status: "ended"},
+		},
+	})
+
+	w = httptest.NewRecorder()
+	pl.handleProcsReq(w, httptest.NewRequest("GET", "/procs/req1/history", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for discarded task, got %d", w.Code)
+	}
+
+	pl.SetOptions(ProclistOpts{DoneMaxAge: time.Millisecond})
+	time.Sleep(10 * time.Millisecond)
+	if done := pl.getDoneProcs(); len(done) != 0 {
+		t.Errorf("len(done) = %d; expecting 0 after DoneMaxAge", len(done))
+	}
+}
+
+func TestTaskHierarchy(t *testing.T) {
+	var pl Proclist
+	pl.Start("root", nil, nil)
+	pl.Start("child1", &ProcOpts{Parent: "root", StopCancelPanic: true}, nil)
+	pl.Start("child2", &ProcOpts{Parent: "root", ForbidCancel: true}, nil)
+	pl.Start("grandchild", &ProcOpts{Parent: "child1"}, nil)
+	pl.Start("other", nil, nil)
+
+	children, err := pl.getChildren("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProcResponse(t, &ProcResponse{Procs: children}, &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "child1", Status: "init"},
+			ProcDetail{Id: "child2", Status: "init"},
+			ProcDetail{Id: "grandchild", Status: "init"},
+		},
+	})
+	for _, c := range children {
+		if c.Id == "grandchild" && c.ParentId != "child1" {
+			t.Errorf("bad parent for grandchild: %s", c.ParentId)
+		}
+	}
+
+	if err := pl.Kill("root", "bye"); err != nil {
+		t.Fatal(err)
+	}
+	checkProcResponse(t, &ProcResponse{Procs: pl.getProcs()}, &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "root", Status: "[cancel request: bye]", Cancelling: true},
+			ProcDetail{Id: "child1", Status: "[cancel request: bye]", Cancelling: true},
+			ProcDetail{Id: "child2", Status: "init"},
+			ProcDetail{Id: "grandchild", Status: "[cancel request: bye]", Cancelling: true},
+			ProcDetail{Id: "other", Status: "init"},
+		},
+	})
+
+	func() {
+		defer pl.Done("child1")
+		pl.CheckCancel("child1")
+	}()
+	if children, _ := pl.getChildren("root"); len(children) != 1 {
+		t.Errorf("len(children) = %d; expecting 1", len(children))
+	}
+
+	// Descendants of a task that forbids cancellation are still killed
+	pl.Start("root2", &ProcOpts{ForbidCancel: true}, nil)
+	defer pl.Done("root2")
+	pl.Start("child3", &ProcOpts{Parent: "root2"}, nil)
+	defer pl.Done("child3")
+	if err := pl.Kill("root2", "bye"); err != ErrForbidden {
+		t.Errorf("Kill() returned %v; expecting ErrForbidden", err)
+	}
+	children, _ = pl.getChildren("root2")
+	checkProcResponse(t, &ProcResponse{Procs: children}, &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "child3", Status: "[cancel request: bye]", Cancelling: true},
+		},
+	})
+}
+
+func TestParentDefaults(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{ForbidCancel: true, Timeout: time.Hour, LogMaxLines: 5})
+	pl.Start("root", nil, nil)
+	defer pl.Done("root")
+	pl.Start("child1", &ProcOpts{Parent: "root"}, nil)
+	defer pl.Done("child1")
+	pl.Start("child2", &ProcOpts{Parent: "root", StopCancelPanic: true}, nil)
+	defer pl.Done("child2")
+
+	p, _ := pl.lookup("child1")
+	want := ProcOpts{Parent: "root", ForbidCancel: true, Timeout: time.Hour, LogMaxLines: 5}
+	if p.opts != want {
+		t.Errorf("bad options for child1: %+v", p.opts)
+	}
+	p, _ = pl.lookup("child2")
+	want = ProcOpts{Parent: "root", StopCancelPanic: true}
+	if p.opts != want {
+		t.Errorf("bad options for child2: %+v", p.opts)
+	}
+	if children, _ := pl.getChildren("root"); len(children) != 2 {
+		t.Errorf("len(children) = %d; expecting 2", len(children))
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var pl Proclist
+	events, unsubscribe := pl.Subscribe()
+
+	pl.Start("req1", &ProcOpts{StopCancelPanic: true}, &map[string]interface{}{"uri": "/"})
+	pl.SetAttribute("req1", "host", "localhost")
+	pl.Status("req1", "working")
+	pl.DelAttribute("req1", "host")
+	func() {
+		defer pl.Done("req1")
+		pl.Kill("req1", "")
+		pl.CheckCancel("req1")
+	}()
+	unsubscribe()
+
+	expected := []Event{
+		{Type: EventStart, Id: "req1", Status: "init"},
+		{Type: EventAttribute, Id: "req1"},
+		{Type: EventStatus, Id: "req1", Status: "working"},
+		{Type: EventAttribute, Id: "req1"},
+		{Type: EventCancelRequest, Id: "req1", Status: "[cancel request]"},
+		{Type: EventDone, Id: "req1", Status: "killed"},
+	}
+	var received []Event
+	for ev := range events {
+		received = append(received, ev)
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("received %d events; expecting %d", len(received), len(expected))
+	}
+	for i, ev := range received {
+		if ev.Type != expected[i].Type || ev.Id != expected[i].Id || ev.Status != expected[i].Status {
+			t.Errorf("bad event %d: %+v", i, ev)
+		}
+	}
+	if received[0].Attrs["uri"] != "/" {
+		t.Error("missing attributes in start event")
+	}
+	if v, present := received[3].Attrs["host"]; !present || v != nil {
+		t.Error("bad attribute deletion event")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var pl Proclist
+	var calls []string
+	record := func(hook string) func(Event) {
+		return func(ev Event) {
+			calls = append(calls, hook+":"+ev.Id)
+		}
+	}
+	remove := pl.AddHooks(HookFuncs{
+		Start:       record("start"),
+		Status:      record("status"),
+		Attribute:   record("attribute"),
+		KillRequest: record("kill"),
+		Done: func(ev Event) {
+			calls = append(calls, "done:"+ev.Id+":"+ev.Outcome)
+		},
+	})
+
+	pl.Start("req1", &ProcOpts{StopCancelPanic: true}, nil)
+	pl.SetAttribute("req1", "host", "localhost")
+	pl.Status("req1", "working")
+	func() {
+		defer pl.Done("req1")
+		pl.Kill("req1", "")
+		pl.CheckCancel("req1")
+	}()
+	remove()
+	pl.Start("req2", nil, nil)
+	pl.Done("req2")
+
+	expected := "start:req1,attribute:req1,status:req1,kill:req1,done:req1:killed"
+	if got := strings.Join(calls, ","); got != expected {
+		t.Errorf("hooks called as %s; expecting %s", got, expected)
+	}
+
+	release := make(chan struct{})
+	delivered := 0
+	deliver := func(Event) {
+		<-release
+		delivered++
+	}
+	async := NewAsyncHooks(HookFuncs{
+		Start:  deliver,
+		Status: deliver,
+		Done:   deliver,
+	}, 2)
+	remove = pl.AddHooks(async)
+	pl.Start("req3", nil, nil)
+	for i := 0; i < 10; i++ {
+		pl.Status("req3", "working")
+	}
+	pl.Done("req3")
+	remove()
+	close(release)
+	async.Close()
+
+	if async.Dropped() == 0 || delivered+int(async.Dropped()) != 12 {
+		t.Errorf("delivered %d events, dropped %d; expecting 12 overall with drops",
+			delivered, async.Dropped())
+	}
+}
+
+func TestHooksCallingBack(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{StopCancelPanic: true, DoneMaxCount: 1})
+	var calls []string
+	pl.AddHooks(HookFuncs{
+		Start: func(ev Event) {
+			if pl.Options().StopCancelPanic {
+				pl.Kill(ev.Id, "from hook")
+			}
+		},
+		Status: func(ev Event) {
+			var b bytes.Buffer
+			pl.WriteMetrics(&b)
+			calls = append(calls, "status "+strconv.Itoa(len(pl.getProcs())))
+		},
+		Attribute: func(ev Event) {
+			pl.SetOptions(pl.Options())
+			calls = append(calls, "attribute")
+		},
+		KillRequest: func(ev Event) {
+			history, _ := pl.getHistory(ev.Id)
+			calls = append(calls, "kill "+strconv.Itoa(len(history)))
+		},
+		Done: func(ev Event) {
+			calls = append(calls, "done "+strconv.Itoa(len(pl.getDoneProcs())))
+		},
+	})
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		pl.Start("req1", nil, nil)
+		defer pl.Done("req1")
+		pl.SetAttribute("req1", "host", "localhost")
+		pl.Status("req1", "working")
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task blocked by a hook calling back into the Proclist")
+	}
+
+	expected := []string{"kill 2", "attribute", "status 1", "done 1"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Errorf("hooks called as %v; expecting %v", calls, expected)
+	}
+	done := pl.getDoneProcs()
+	if len(done) != 1 || !strings.Contains(done[0].Status, "from hook") {
+		t.Errorf("kill from OnStart hook not applied: %+v", done)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pm.journal")
+	j, err := OpenJournal(path, JournalOpts{MaxSize: 512, MaxFiles: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pl Proclist
+	pl.SetJournal(j)
+
+	pl.Start("req1", &ProcOpts{StopCancelPanic: true}, &map[string]interface{}{"uri": "/"})
+	pl.SetAttribute("req1", "host", "localhost")
+	pl.Status("req1", "working")
+	pl.DelAttribute("req1", "uri")
+	func() {
+		defer pl.Done("req1")
+		pl.Kill("req1", "")
+		pl.CheckCancel("req1")
+	}()
+	pl.Start("req2", &ProcOpts{Parent: "req1"}, nil)
+	pl.Done("req2")
+	pl.Start("req2", nil, nil)
+	pl.Status("req2", "hanging")
+	pl.denyCancel("req2", "127.0.0.1:1234", "Forbidden")
+	pl.denyCancel("", "127.0.0.1:1234", "Forbidden")
+
+	// Simulate a crash, with the last entry partially written
+	pl.SetJournal(nil)
+	if err := j.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pl.Done("req2")
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("journal not rotated: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"type":"status","id":"req2","st`)
+	f.Close()
+
+	tasks, err := ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []JournalTask{
+		{Id: "req1", Attrs: map[string]interface{}{"host": "localhost"}, Outcome: "killed",
+			History: []HistoryDetail{{Status: "init"}, {Status: "working"},
+				{Status: "[cancel request]"}, {Status: "killed"}}},
+		{Id: "req2", ParentId: "req1", Attrs: map[string]interface{}{}, Outcome: "ended",
+			History: []HistoryDetail{{Status: "init"}, {Status: "ended"}}},
+		{Id: "req2", Attrs: map[string]interface{}{},
+			History: []HistoryDetail{{Status: "init"}, {Status: "hanging"},
+				{Status: "[cancel request denied: Forbidden]"}}},
+	}
+	if len(tasks) != len(expected) {
+		t.Fatalf("read %d tasks; expecting %d: %+v", len(tasks), len(expected), tasks)
+	}
+	for i, task := range tasks {
+		e := expected[i]
+		if task.Id != e.Id || task.ParentId != e.ParentId || task.Outcome != e.Outcome ||
+			!attrMapEquals(task.Attrs, e.Attrs) || len(task.History) != len(e.History) {
+			t.Errorf("bad task %d: %+v", i, task)
+			continue
+		}
+		for k, h := range task.History {
+			if h.Status != e.History[k].Status || h.Ts.IsZero() {
+				t.Errorf("bad history entry %d for task %d: %+v", k, i, h)
+			}
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("garbage\n{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadJournal(path); err != ErrBadJournal {
+		t.Errorf("unexpected error for a malformed journal: %v", err)
+	}
+
+	// Events written late by some other routine are dropped
+	var jr journalReader
+	jr.apply(Event{Type: EventStart, Id: "req1", Generation: 1})
+	jr.apply(Event{Type: EventDone, Id: "req1", Generation: 1, Outcome: "ended"})
+	jr.apply(Event{Type: EventCancelRequest, Id: "req1", Generation: 1})
+	if len(jr.tasks) != 1 || len(jr.tasks[0].History) != 2 {
+		t.Errorf("bad tasks for late events: %+v", jr.tasks)
+	}
+}
+
+func TestJournalSlowWrite(t *testing.T) {
+	j, err := OpenJournal(filepath.Join(t.TempDir(), "pm.journal"), JournalOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	var pl Proclist
+	pl.SetJournal(j)
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+
+	// Hold the journal, as if stuck writing to disk
+	j.mu.Lock()
+	go pl.Status("req1", "working")
+	time.Sleep(10 * time.Millisecond)
+
+	listed := make(chan int)
+	go func() {
+		procs := pl.getProcs()
+		pl.SetJournal(nil)
+		pl.Start("req2", nil, nil)
+		pl.Done("req2")
+		listed <- len(procs)
+	}()
+	select {
+	case n := <-listed:
+		if n != 1 {
+			t.Errorf("len(procs) = %d; expecting 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("process list blocked by a slow journal")
+	}
+	j.mu.Unlock()
+}
+
+func TestEventStream(t *testing.T) {
+	var pl Proclist
+	server := httptest.NewServer(http.HandlerFunc(pl.handleProcsReq))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/procs/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get(HeaderContentType); ct != MediaEventStream {
+		t.Fatalf("bad content type: %s", ct)
+	}
+
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal([]byte(line[len("data: "):]), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != EventStart || ev.Id != "req1" {
+			t.Errorf("bad event received: %+v", ev)
+		}
+		return
+	}
+	t.Fatal("no event received")
+}
+
+func TestTaskLog(t *testing.T) {
+	var pl Proclist
+	pl.Start("req1", &ProcOpts{LogMaxLines: 2}, nil)
+	for i := 1; i <= 3; i++ {
+		pl.Logf("req1", "line %d", i)
+	}
+	pl.Logf("unknown", "ignored")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/procs/req1/log", nil)
+	pl.handleProcsReq(w, r)
+	var lr LogResponse
+	if err := json.NewDecoder(w.Body).Decode(&lr); err != nil {
+		t.Fatal(err)
+	}
+	if len(lr.Lines) != 2 || lr.Lines[0].Seq != 2 || lr.Lines[0].Text != "line 2" ||
+		lr.Lines[1].Seq != 3 || lr.Lines[1].Text != "line 3" {
+		t.Errorf("unexpected log lines: %+v", lr.Lines)
+	}
+	history, _ := pl.getHistory("req1")
+	if len(history) != 1 {
+		t.Errorf("log lines added to history: %+v", history)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(pl.handleProcsReq))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/procs/req1/log?follow=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get(HeaderContentType); ct != MediaEventStream {
+		t.Fatalf("bad content type: %s", ct)
+	}
+
+	var received []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ll LogLine
+		if err := json.Unmarshal([]byte(line[len("data: "):]), &ll); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, ll.Text)
+		switch len(received) {
+		case 2:
+			pl.Logf("req1", "line %d", 4)
+		case 3:
+			pl.Done("req1")
+		}
+	}
+	expected := "line 2,line 3,line 4"
+	if got := strings.Join(received, ","); got != expected {
+		t.Errorf("followed %s; expecting %s", got, expected)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/procs/req1/log", nil)
+	pl.handleProcsReq(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET log for unknown task returned %d", w.Code)
+	}
+
+	pl.Start("req2", nil, nil)
+	defer pl.Done("req2")
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/procs/req2/log?follow=maybe", nil)
+	pl.handleProcsReq(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET log with bad follow parameter returned %d", w.Code)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	var pl Proclist
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+	events, unsubscribe := pl.Subscribe()
+	defer unsubscribe()
+
+	do := func(method, path, token string) int {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set(HeaderAuthorization, "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		pl.handleProcsReq(w, r)
+		return w.Code
+	}
+
+	pl.SetAuthorizer(TokenAuthorizer{"reader": PermRead, "admin": PermAll})
+	for _, c := range []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/procs/", "", http.StatusUnauthorized},
+		{"GET", "/procs/", "bogus", http.StatusUnauthorized},
+		{"GET", "/procs/", "reader", http.StatusOK},
+		{"GET", "/procs/req1/history", "reader", http.StatusOK},
+		{"DELETE", "/procs/req1", "reader", http.StatusForbidden},
+		{"DELETE", "/procs/req1", "reader", http.StatusForbidden},
+		{"DELETE", "/procs/req1", "", http.StatusUnauthorized},
+		{"POST", "/procs/req1", "reader", http.StatusForbidden},
+		{"POST", "/procs/kill", "reader", http.StatusForbidden},
+		{"POST", "/procs/kill", "reader", http.StatusForbidden},
+		{"DELETE", "/procs/req1", "admin", http.StatusOK},
+	} {
+		if code := do(c.method, c.path, c.token); code != c.code {
+			t.Errorf("%s %s with token %q: got %d, expecting %d",
+				c.method, c.path, c.token, code, c.code)
+		}
+	}
+
+	ev := <-events
+	if ev.Type != EventCancelDenied || ev.Id != "req1" || ev.Generation == 0 {
+		t.Errorf("bad event for refused kill: %+v", ev)
+	}
+	ev = <-events
+	if ev.Type != EventCancelDenied || ev.Id != "" {
+		t.Errorf("bad event for refused kill by filter: %+v", ev)
+	}
+	if ev = <-events; ev.Type != EventCancelRequest {
+		t.Errorf("repeated denials not coalesced: %+v", ev)
+	}
+	history, _ := pl.getHistory("req1")
+	checkHistoryResponse(t, &HistoryResponse{History: history}, &HistoryResponse{
+		History: []HistoryDetail{
+			HistoryDetail{Status: "init"},
+			HistoryDetail{Status: "[cancel request denied: Unauthorized (3 times)]"},
+			HistoryDetail{Status: "[cancel request]"},
+		},
+	})
+
+	key := []byte("secret")
+	pl.SetAuthorizer(&HMACAuthorizer{Key: key, Perms: PermRead})
+	r := httptest.NewRequest("GET", "/procs/req1/history", nil)
+	if err := SignRequest(r, key); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	pl.handleProcsReq(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("signed request refused: %d", w.Code)
+	}
+
+	body := strings.NewReader(strings.Repeat("x", 2*MaxSignedBody))
+	r = httptest.NewRequest("POST", "/procs/kill", body)
+	r.Header.Set(HeaderAuthorization, authHMAC+"00")
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+	w = httptest.NewRecorder()
+	pl.handleProcsReq(w, r)
+	if w.Code != http.StatusUnauthorized || body.Len() < MaxSignedBody/2 {
+		t.Errorf("large body: got %d with %d bytes unread", w.Code, body.Len())
+	}
+	if err := SignRequest(httptest.NewRequest("POST", "/procs/kill",
+		strings.NewReader(strings.Repeat("x", MaxSignedBody+1))), key); err != ErrBodyTooLarge {
+		t.Errorf("unexpected error signing a large body: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/procs/req1/history", nil)
+	SignRequest(r, []byte("wrong"))
+	w = httptest.NewRecorder()
+	pl.handleProcsReq(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("badly signed request: got %d, expecting 401", w.Code)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{DoneMaxCount: 2})
+	pl.Start("req1", nil, nil)
+	pl.Start("req2", nil, nil)
+	pl.Start("req3", nil, nil)
+	defer pl.Done("req2")
+	defer pl.Done("req3")
+	pl.Progress("unknown", 1, 2, "")
+
+	p1, _ := pl.lookup("req1")
+	t0 := time.Now()
+	p1.setProgress(t0, 10, 100, "rows")
+	p1.setProgress(t0.Add(10*time.Second), 35, 100, "rows")
+	pl.Progress("req2", 80, 100, "rows")
+	pl.Progress("req3", 5, 0, "bytes")
+
+	q := ProcQuery{Sort: "-progress"}
+	procs, _ := q.apply(pl.getProcs(), time.Now())
+	if len(procs) != 3 || procs[0].Id != "req2" || procs[1].Id != "req1" || procs[2].Id != "req3" {
+		t.Fatalf("bad order by progress: %+v", procs)
+	}
+	pr := procs[1].Progress
+	eta := t0.Add(36 * time.Second)
+	if pr == nil || pr.Done != 35 || pr.Total != 100 || pr.Unit != "rows" || pr.Percent != 35 ||
+		pr.Rate != 2.5 || pr.ETA == nil || !pr.ETA.Equal(eta) {
+		t.Errorf("bad progress for req1: %+v", pr)
+	}
+	if pr := procs[2].Progress; pr == nil || pr.Done != 5 || pr.Percent != 0 || pr.ETA != nil {
+		t.Errorf("bad progress for req3: %+v", pr)
+	}
+
+	p1.setProgress(t0.Add(20*time.Second), 5, 100, "rows")
+	pl.Done("req1")
+	done := pl.getDoneProcs()
+	if len(done) != 1 || done[0].Progress == nil || done[0].Progress.Done != 5 ||
+		done[0].Progress.Rate != 0 || done[0].Progress.ETA != nil {
+		t.Errorf("bad progress for done task: %+v", done)
+	}
+}
+
+func TestProcQuery(t *testing.T) {
+	var pl Proclist
+	for i, host := range []string{"db1", "db2", "web1", "web2"} {
+		id := fmt.Sprintf("req%d", i+1)
+		pl.Start(id, nil, &map[string]interface{}{"host": host, "n": i})
+		defer pl.Done(id)
+		if i%2 == 0 {
+			pl.Status(id, "reading")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pl.Kill("req4", "")
+
+	cancelling := true
+	for _, c := range []struct {
+		q        ProcQuery
+		expected []string
+		total    int
+	}{
+		{ProcQuery{Sort: "id"}, []string{"req1", "req2", "req3", "req4"}, 4},
+		{ProcQuery{Sort: "-procTime", Limit: 2}, []string{"req4", "req3"}, 4},
+		{ProcQuery{Sort: "id", Offset: 3}, []string{"req4"}, 4},
+		{ProcQuery{ProcFilter: ProcFilter{Status: []string{"reading"}}, Sort: "id"}, []string{"req1", "req3"}, 2},
+		{ProcQuery{ProcFilter: ProcFilter{Attrs: map[string]string{"n": "1"}}}, []string{"req2"}, 1},
+		{ProcQuery{ProcFilter: ProcFilter{AttrPrefix: map[string]string{"host": "web"}}, Sort: "id"}, []string{"req3", "req4"}, 2},
+		{ProcQuery{ProcFilter: ProcFilter{Cancelling: &cancelling}}, []string{"req4"}, 1},
+		{ProcQuery{ProcFilter: ProcFilter{MinAge: time.Hour}}, []string{}, 0},
+	} {
+		q, err := ParseProcQuery(c.q.Values())
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		pl.handleProcsReq(w, httptest.NewRequest("GET", "/procs/?"+q.Values().Encode(), nil))
+		var pr ProcResponse
+		if err := json.NewDecoder(w.Body).Decode(&pr); err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []string{}
+		for _, p := range pr.Procs {
+			ids = append(ids, p.Id)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(c.expected) || pr.Total != c.total {
+			t.Errorf("query %s: got %v (total %d), expecting %v (total %d)",
+				c.q.Values().Encode(), ids, pr.Total, c.expected, c.total)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	pl.handleProcsReq(w, httptest.NewRequest("GET", "/procs/?sort=bogus", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad query: got %d, expecting 400", w.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{StopCancelPanic: true, MetricsAttrs: []string{"host", "status"}})
+
+	pl.Start("req1", nil, &map[string]interface{}{"host": "db1"})
+	defer pl.Done("req1")
+	pl.Status("req1", "reading")
+	for _, id := range []string{"req2", "req3"} {
+		func() {
+			pl.Start(id, nil, nil)
+			defer pl.Done(id)
+			pl.Status(id, "writing")
+			if id == "req3" {
+				pl.Kill(id, "")
+				pl.CheckCancel(id)
+			}
+		}()
+	}
+
+	w := httptest.NewRecorder()
+	pl.handleMetricsReq(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+	for _, line := range []string{
+		`pm_tasks_active{status="reading",host="db1"} 1`,
+		`pm_tasks_finished_total{outcome="ended"} 1`,
+		`pm_tasks_finished_total{outcome="killed"} 1`,
+		`pm_task_duration_seconds_count{outcome="killed"} 1`,
+		`pm_task_status_duration_seconds_count{status="writing"} 2`,
+		`pm_task_status_duration_seconds_bucket{status="init",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("missing metric: %s", line)
+		}
+	}
+}
+
+func TestMetricsStatusCap(t *testing.T) {
+	var pl Proclist
+	for i := 0; i < MaxMetricsStatuses+10; i++ {
+		pl.Start("req1", nil, nil)
+		pl.Status("req1", fmt.Sprintf("status %d", i))
+		pl.Done("req1")
+	}
+	pl.metrics.mu.Lock()
+	defer pl.metrics.mu.Unlock()
+	if n := len(pl.metrics.statusDuration); n != MaxMetricsStatuses+1 {
+		t.Errorf("len(statusDuration) = %d; expecting %d", n, MaxMetricsStatuses+1)
+	}
+	if h := pl.metrics.statusDuration[OtherStatus]; h == nil || h.count != 11 {
+		t.Errorf("bad histogram for other statuses: %+v", h)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{Timeout: 20 * time.Millisecond})
+	ctx := pl.StartContext(context.Background(), "req1", nil, nil)
+	defer pl.Done("req1")
+	pl.Start("req2", &ProcOpts{Timeout: time.Hour}, nil)
+	defer pl.Done("req2")
+	pl.Start("req3", &ProcOpts{}, nil)
+	defer pl.Done("req3")
+
+	for _, p := range pl.getProcs() {
+		switch p.Id {
+		case "req1", "req2":
+			if p.Deadline == nil || p.Remaining <= 0 {
+				t.Errorf("bad deadline for %s: %v (%v)", p.Id, p.Deadline, p.Remaining)
+			}
+		case "req3":
+			if p.Deadline != nil {
+				t.Error("deadline set for task without timeout")
+			}
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("task not canceled after its deadline")
+	}
+	if cause := context.Cause(ctx); cause != CancelErr("killed: "+DeadlineExceeded) {
+		t.Errorf("bad cancel cause: %v", cause)
+	}
+	checkProcResponse(t, &ProcResponse{Procs: pl.getProcs()}, &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "req1", Status: "[cancel request: deadline exceeded]", Cancelling: true},
+			ProcDetail{Id: "req2", Status: "init"},
+			ProcDetail{Id: "req3", Status: "init"},
+		},
+	})
+}
+
+func TestStallWatchdog(t *testing.T) {
+	var pl Proclist
+	stalled := make(chan ProcDetail, 10)
+	pl.SetOptions(ProclistOpts{
+		StallThreshold: 20 * time.Millisecond,
+		KillStalled:    true,
+		StallHandler:   func(p ProcDetail) { stalled <- p },
+	})
+	events, unsubscribe := pl.Subscribe()
+	defer unsubscribe()
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+	pl.Start("req2", &ProcOpts{StallThreshold: time.Hour}, nil)
+	defer pl.Done("req2")
+
+	expected := []EventType{EventStart, EventStart, EventStalled, EventCancelRequest}
+	for _, et := range expected {
+		select {
+		case ev := <-events:
+			if ev.Type != et {
+				t.Fatalf("bad event: %+v; expecting %s", ev, et)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s event", et)
+		}
+	}
+
+	p := <-stalled
+	if p.Id != "req1" || !p.Stalled || p.Status != "init" {
+		t.Errorf("bad stalled task: %+v", p)
+	}
+
+	// The cancellation request must not re-arm the watchdog
+	time.Sleep(100 * time.Millisecond)
+	if n := len(stalled); n != 0 {
+		t.Errorf("StallHandler called %d more times", n)
+	}
+	procs := pl.getProcs()
+	checkProcResponse(t, &ProcResponse{Procs: procs}, &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "req1", Status: "[cancel request: stalled]", Cancelling: true},
+			ProcDetail{Id: "req2", Status: "init"},
+		},
+	})
+	for _, p := range procs {
+		if p.Stalled != (p.Id == "req1") {
+			t.Errorf("bad stalled flag for %s: %v", p.Id, p.Stalled)
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var pl Proclist
+	var out bytes.Buffer
+	pl.SetOptions(ProclistOpts{
+		LogHandler:      slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}),
+		LogHistory:      true,
+		LogHistoryLevel: slog.LevelWarn,
+		DoneMaxCount:    2,
+	})
+
+	task := pl.StartTask(context.Background(), "req1", nil, &map[string]interface{}{"host": "localhost"})
+	logger := task.Logger()
+	logger.Debug("hidden")
+	logger.Info("hello")
+	logger.Warn("careful", "n", 3)
+	logger.With("k", "v").WithGroup("g").With("x", 1).Warn("grouped", "y", 2)
+	task.Done()
+	logger.Error("late")
+
+	if s := out.String(); strings.Contains(s, "hidden") ||
+		!strings.Contains(s, "msg=hello pm_task=req1") || !strings.Contains(s, "msg=late") {
+		t.Errorf("unexpected log output: %s", s)
+	}
+	history, _ := pl.getHistory("req1")
+	checkHistoryResponse(t, &HistoryResponse{History: history}, &HistoryResponse{
+		History: []HistoryDetail{
+			HistoryDetail{Status: "init"},
+			HistoryDetail{Status: "[WARN] careful n=3"},
+			HistoryDetail{Status: "[WARN] grouped k=v g.x=1 g.y=2"},
+			HistoryDetail{Status: "ended"},
+		},
+	})
+
+	// History logging is off by default
+	pl.SetOptions(ProclistOpts{LogHandler: slog.NewTextHandler(&out, nil), DoneMaxCount: 2})
+	task = pl.StartTask(context.Background(), "req3", nil, nil)
+	task.Logger().Error("not in history")
+	task.Done()
+	history, _ = pl.getHistory("req3")
+	checkHistoryResponse(t, &HistoryResponse{History: history}, &HistoryResponse{
+		History: []HistoryDetail{
+			HistoryDetail{Status: "init"},
+			HistoryDetail{Status: "ended"},
+		},
+	})
+
+	out.Reset()
+	task = pl.StartTask(context.Background(), "req2", nil, &map[string]interface{}{"host": "localhost"})
+	defer task.Done()
+	logger = slog.New(NewLogHandler(slog.NewTextHandler(&out, nil), "host", "missing"))
+	logger.InfoContext(task.Context(), "tagged")
+	logger.With("k", "v").InfoContext(context.Background(), "untagged")
+	if s := out.String(); !strings.Contains(s, "msg=tagged pm_task=req2 host=localhost\n") ||
+		!strings.Contains(s, "msg=untagged k=v\n") {
+		t.Errorf("unexpected log output: %s", s)
+	}
+}
+
+func TestTask(t *testing.T) {
+	var pl Proclist
+	task := pl.StartTask(context.Background(), "req1", &ProcOpts{StopCancelPanic: true}, nil)
+	if task.Id() != "req1" {
+		t.Errorf("bad task id: %s", task.Id())
+	}
+	task.SetAttribute("host", "localhost")
+	task.SetAttribute("tmp", 1)
+	task.DelAttribute("tmp")
+	task.Status("working")
+
+	procs := pl.getProcs()
+	if len(procs) != 1 || procs[0].Status != "working" ||
+		!attrMapEquals(procs[0].Attrs, map[string]interface{}{"host": "localhost"}) {
+		t.Fatalf("bad process list: %+v", procs)
+	}
+
+	func() {
+		defer task.Done()
+		pl.Kill("req1", "")
+		if task.Context().Err() == nil {
+			t.Error("task context not canceled")
+		}
+		task.CheckCancel()
+		t.Error("task was not cancelled when it had to")
+	}()
+	if len(pl.getProcs()) != 0 {
+		t.Error("task still running after Done()")
+	}
+
+	// A stale handle must not finish a new task reusing the same id
+	pl.Start("req1", nil, nil)
+	task.Done()
+	if len(pl.getProcs()) != 1 {
+		t.Error("stale handle finished a new task")
+	}
+}
+
+func TestDuplicateIds(t *testing.T) {
+	var pl Proclist
+	if err := pl.StartE("req1", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Done("req1")
+	if err := pl.StartE("req1", nil, nil); err != ErrDuplicateId {
+		t.Errorf("expected ErrDuplicateId, got %v", err)
+	}
+	if _, err := pl.StartTaskE(context.Background(), "req1", nil, nil); err != ErrDuplicateId {
+		t.Errorf("expected ErrDuplicateId, got %v", err)
+	}
+
+	t1 := pl.StartTask(context.Background(), "", nil, nil)
+	defer t1.Done()
+	t2 := pl.StartTask(context.Background(), "", nil, nil)
+	defer t2.Done()
+	if t1.Id() == "" || t1.Id() == t2.Id() || t1.Id() == "req1" {
+		t.Errorf("bad generated ids: %q, %q", t1.Id(), t2.Id())
+	}
+	if t1.Generation() >= t2.Generation() {
+		t.Errorf("bad generations: %d, %d", t1.Generation(), t2.Generation())
+	}
+
+	kill := func(gen uint64) int {
+		b, _ := json.Marshal(CancelRequest{Generation: gen})
+		w := httptest.NewRecorder()
+		pl.handleProcsReq(w, httptest.NewRequest("DELETE", "/procs/"+t2.Id(), bytes.NewReader(b)))
+		return w.Code
+	}
+	if code := kill(t1.Generation()); code != http.StatusNotFound {
+		t.Errorf("kill with stale generation: got %d, expecting 404", code)
+	}
+	if code := kill(t2.Generation()); code != http.StatusOK {
+		t.Errorf("kill with right generation: got %d, expecting 200", code)
+	}
+}
+
+func TestReplacedTask(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{DoneMaxCount: 10})
+	events, unsubscribe := pl.Subscribe()
+	defer unsubscribe()
+
+	pl.Start("parent", nil, nil)
+	defer pl.Done("parent")
+	t1 := pl.StartTask(context.Background(), "req1", &ProcOpts{Parent: "parent", Timeout: time.Hour}, nil)
+	t2 := pl.StartTask(context.Background(), "req1", nil, nil)
+	defer t2.Done()
+	t1.Done()
+
+	if t1.Context().Err() == nil {
+		t.Error("context of replaced task not canceled at Done()")
+	}
+	if t2.Context().Err() != nil {
+		t.Error("context of replacing task canceled")
+	}
+	t1.p.mu.RLock()
+	timerStopped := t1.p.timer.Stop() == false
+	t1.p.mu.RUnlock()
+	if !timerStopped {
+		t.Error("deadline timer still armed for replaced task")
+	}
+	if children, _ := pl.getChildren("parent"); len(children) != 0 {
+		t.Errorf("replaced task still linked to its parent: %+v", children)
+	}
+	if p, _ := pl.lookup("req1"); p != t2.p {
+		t.Error("replacing task removed from the list")
+	}
+	done := pl.getDoneProcs()
+	if len(done) != 1 || done[0].Generation != t1.Generation() || done[0].Status != "ended" {
+		t.Errorf("replaced task not retained as ended: %+v", done)
+	}
+
+	gens := map[EventType][]uint64{}
+	for len(events) > 0 {
+		ev := <-events
+		if ev.Id == "req1" {
+			gens[ev.Type] = append(gens[ev.Type], ev.Generation)
+		}
+	}
+	if g := gens[EventStart]; len(g) != 2 || g[0] != t1.Generation() || g[1] != t2.Generation() {
+		t.Errorf("bad generations in start events: %v", g)
+	}
+	if g := gens[EventDone]; len(g) != 1 || g[0] != t1.Generation() {
+		t.Errorf("bad generations in done events: %v", g)
+	}
+
+	// A stale Done() by identifier finishes the replaced task, not the new one
+	pl.Start("req2", nil, nil)
+	first, _ := pl.lookup("req2")
+	pl.Start("req2", nil, nil)
+	second, _ := pl.lookup("req2")
+	pl.Done("req2")
+	if p, present := pl.lookup("req2"); !present || p != second {
+		t.Error("stale Done() finished the replacing task")
+	}
+	if done := pl.getDoneProcs(); done[0].Generation != first.gen {
+		t.Errorf("replaced task not finished by Done(): %+v", done[0])
+	}
+	pl.Done("req2")
+	if _, present := pl.lookup("req2"); present || len(pl.replaced) != 0 {
+		t.Error("replacing task not finished by the second Done()")
+	}
+}
+
+func blockInTask(pl *Proclist, ready, exit chan struct{}) {
+	pl.Start("req1", nil, &map[string]interface{}{"uri": "/hosts"})
+	defer pl.Done("req1")
+	ready <- struct{}{}
+	<-exit
+}
+
+func TestProfileLabels(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{ProfileLabels: true, ProfileAttrs: []string{"uri"}})
+	ready, exit := make(chan struct{}), make(chan struct{})
+	go blockInTask(&pl, ready, exit)
+	<-ready
+	defer close(exit)
+
+	w := httptest.NewRecorder()
+	pl.handleProcsReq(w, httptest.NewRequest("GET", "/procs/req1/stack", nil))
+	stack := w.Body.String()
+	if !strings.Contains(stack, "blockInTask") {
+		t.Errorf("task stack not found:\n%s", stack)
+	}
+	if !strings.Contains(stack, `"uri":"/hosts"`) {
+		t.Errorf("attribute label not found:\n%s", stack)
+	}
+	if strings.Contains(stack, "TestProfileLabels") {
+		t.Errorf("unrelated stack found:\n%s", stack)
+	}
+
+	pl.SetOptions(ProclistOpts{})
+	w = httptest.NewRecorder()
+	pl.handleProcsReq(w, httptest.NewRequest("GET", "/procs/req1/stack", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("stack without ProfileLabels: got %d, expecting 501", w.Code)
+	}
+}
+
+func TestPanicDetails(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{DoneMaxCount: 2})
+	pl.Start("req1", nil, nil)
+	func() {
+		defer func() {
+			if e := recover(); e != "boom" {
+				t.Errorf("unexpected panic: %v", e)
+			}
+		}()
+		defer pl.Done("req1")
+		panic("boom")
+	}()
+
+	checkPanic := func(where string, pd *PanicDetail) {
+		if pd == nil {
+			t.Errorf("missing panic details in %s", where)
+			return
+		}
+		if pd.Value != "boom" || !strings.Contains(pd.Location, "TestPanicDetails") ||
+			!strings.Contains(pd.Stack, "TestPanicDetails") {
+			t.Errorf("bad panic details in %s: %+v", where, pd)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/procs/req1/history", nil)
+	pl.handleProcsReq(w, r)
+	var hr HistoryResponse
+	if err := json.NewDecoder(w.Body).Decode(&hr); err != nil {
+		t.Fatal(err)
+	}
+	checkHistoryResponse(t, &hr, &HistoryResponse{
+		History: []HistoryDetail{
+			HistoryDetail{Status: "init"},
+			HistoryDetail{Status: "aborted"},
+		},
+	})
+	if hr.History[0].Panic != nil {
+		t.Error("unexpected panic details for the first history entry")
+	}
+	checkPanic("history", hr.History[1].Panic)
+
+	done := pl.getDoneProcs()
+	if len(done) != 1 {
+		t.Fatalf("%d done tasks; expecting 1", len(done))
+	}
+	checkPanic("done tasks", done[0].Panic)
+
+	pl.Start("req2", nil, nil)
+	func() {
+		defer func() { recover() }()
+		defer pl.Done("req2")
+		var m map[string]int
+		m["x"] = 1
+	}()
+	history, _ := pl.getHistory("req2")
+	if pd := history[len(history)-1].Panic; pd == nil || !strings.Contains(pd.Location, "TestPanicDetails") {
+		t.Errorf("bad details for runtime error: %+v", pd)
+	}
+}
+
+func TestStopAbortPanic(t *testing.T) {
+	var pl Proclist
+	var aborted []string
+	pl.SetOptions(ProclistOpts{
+		StopCancelPanic: true,
+		StopAbortPanic:  true,
+		DoneMaxCount:    10,
+		AbortHandler: func(id string, e interface{}) {
+			aborted = append(aborted, fmt.Sprintf("%s: %v", id, e))
+		},
+	})
+
+	run := func(f func()) (e interface{}) {
+		defer func() {
+			e = recover()
+		}()
+		f()
+		return nil
+	}
+	if e := run(func() {
+		pl.Start("req1", nil, nil)
+		defer pl.Done("req1")
+		panic("boom")
+	}); e != nil {
+		t.Errorf("panic not stopped at Done(): %v", e)
+	}
+	if e := run(func() {
+		task := pl.StartTask(context.Background(), "req2", nil, nil)
+		defer task.Done()
+		panic(errors.New("bang"))
+	}); e != nil {
+		t.Errorf("panic not stopped at Task.Done(): %v", e)
+	}
+	if e := run(func() {
+		pl.Start("req3", &ProcOpts{}, nil)
+		defer pl.Done("req3")
+		panic("crash")
+	}); e != "crash" {
+		t.Errorf("unexpected panic with StopAbortPanic unset for the task: %v", e)
+	}
+	if e := run(func() {
+		pl.Start("req4", nil, nil)
+		defer pl.Done("req4")
+		pl.Kill("req4", "")
+		pl.CheckCancel("req4")
+	}); e != nil {
+		t.Errorf("cancel panic not stopped at Done(): %v", e)
+	}
+	if e := run(func() {
+		defer pl.Done("unknown")
+		panic("lost")
+	}); e != nil {
+		t.Errorf("panic not stopped at Done() for unknown task: %v", e)
+	}
+	opts := pl.Options()
+	opts.StopAbortPanic = false
+	pl.SetOptions(opts)
+	if e := run(func() {
+		defer pl.Done("unknown")
+		panic("again")
+	}); e != "again" {
+		t.Errorf("unexpected panic with StopAbortPanic unset for unknown task: %v", e)
+	}
+
+	expected := []string{"req1: boom", "req2: bang", "req3: crash", "unknown: lost", "unknown: again"}
+	if strings.Join(aborted, ",") != strings.Join(expected, ",") {
+		t.Errorf("AbortHandler called for %v; expecting %v", aborted, expected)
+	}
+	for _, p := range pl.getDoneProcs() {
+		if p.Id != "req4" && (p.Status != "aborted" || p.Panic == nil) {
+			t.Errorf("bad status for aborted task: %+v", p)
+		}
+	}
+}
+
+func TestCancelErrors(t *testing.T) {
+	var pl Proclist
+	pl.SetOptions(ProclistOpts{DoneMaxCount: 10})
+
+	func() {
+		pl.Start("req1", nil, nil)
+		defer pl.Done("req1")
+		if err := pl.StatusE("req1", "working"); err != nil {
+			t.Fatal(err)
+		}
+		pl.Kill("req1", "bye")
+		if err := pl.CheckCancelE("req1"); err != CancelErr("killed: bye") {
+			t.Errorf("bad cancel error: %v", err)
+		}
+	}()
+
+	func() {
+		task := pl.StartTask(context.Background(), "req2", &ProcOpts{CancelMode: CancelError}, nil)
+		defer task.Done()
+		pl.Kill("req2", "")
+		task.Status("working")
+		task.CheckCancel()
+		if err := task.StatusE("still working"); err != CancelErr("killed") {
+			t.Errorf("bad cancel error: %v", err)
+		}
+	}()
+
+	func() {
+		pl.Start("req3", &ProcOpts{CancelMode: CancelError}, nil)
+		defer pl.Done("req3")
+		pl.Kill("req3", "")
+		pl.Status("req3", "working")
+	}()
+
+	checkProcResponse(t, &ProcResponse{Procs: pl.getDoneProcs()}, &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "req1", Status: "killed: bye", Cancelling: true},
+			ProcDetail{Id: "req2", Status: "killed", Cancelling: true},
+			ProcDetail{Id: "req3", Status: "ended", Cancelling: true},
+		},
+	})
+}
+
+func TestKillMatching(t *testing.T) {
+	var pl Proclist
+	pl.Start("req1", nil, &map[string]interface{}{"host": "bad"})
+	defer pl.Done("req1")
+	pl.Start("req2", &ProcOpts{ForbidCancel: true}, &map[string]interface{}{"host": "bad"})
+	defer pl.Done("req2")
+	pl.Start("req3", nil, &map[string]interface{}{"host": "good"})
+	defer pl.Done("req3")
+	pl.Start("req4", &ProcOpts{Parent: "req2"}, &map[string]interface{}{"host": "good"})
+	defer pl.Done("req4")
+
+	b, _ := json.Marshal(KillRequest{
+		Filter:  ProcFilter{Attrs: map[string]string{"host": "bad"}},
+		Message: "flood",
+	})
+	w := httptest.NewRecorder()
+	pl.handleProcsReq(w, httptest.NewRequest("POST", "/procs/kill", bytes.NewReader(b)))
+	var result KillResponse
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result.Killed) != "[req1 req4]" || fmt.Sprint(result.Forbidden) != "[req2]" {
+		t.Errorf("bad kill result: %+v", result)
+	}
+	checkProcResponse(t, &ProcResponse{Procs: pl.getProcs()}, &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "req1", Status: "[cancel request: flood]", Cancelling: true,
+				Attrs: map[string]interface{}{"host": "bad"}},
+			ProcDetail{Id: "req2", Status: "init", Attrs: map[string]interface{}{"host": "bad"}},
+			ProcDetail{Id: "req3", Status: "init", Attrs: map[string]interface{}{"host": "good"}},
+			ProcDetail{Id: "req4", Status: "[cancel request: flood]", Cancelling: true,
+				Attrs: map[string]interface{}{"host": "good"}},
+		},
+	})
+
+	// Tasks ending before the request gets to them are not reported
+	pl.Start("req5", nil, nil)
+	p, _ := pl.lookup("req5")
+	pl.Done("req5")
+	if marked, forbidden, err := pl.killTree(p, time.Now(), ""); len(marked) != 0 ||
+		len(forbidden) != 0 || err != nil {
+		t.Errorf("ended task reported as killed: %v, %v, %v", marked, forbidden, err)
+	}
+
+	w = httptest.NewRecorder()
+	pl.handleProcsReq(w, httptest.NewRequest("POST", "/procs/kill", strings.NewReader("{}")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("kill with empty filter: got %d, expecting 400", w.Code)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var pl Proclist
+	for _, body := range []string{"{}", `{"grace":0}`, `{"grace":-1}`} {
+		w := httptest.NewRecorder()
+		pl.handleProcsReq(w, httptest.NewRequest("POST", "/procs/drain", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("drain with %s: got %d, expecting 400", body, w.Code)
+		}
+	}
+	if pl.Draining() {
+		t.Error("draining after bad requests")
+	}
+	pl.Start("req1", nil, nil)
+	pl.Start("req2", nil, nil)
+	defer pl.Done("req2")
+	pl.Start("req3", &ProcOpts{ForbidCancel: true}, nil)
+	defer pl.Done("req3")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pl.Done("req1")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report := pl.Drain(ctx)
+
+	if fmt.Sprint(report.Ended) != "[req1]" || fmt.Sprint(report.Killed) != "[req2]" ||
+		fmt.Sprint(report.Forbidden) != "[req3]" {
+		t.Errorf("bad drain report: %+v", report)
+	}
+	if err := pl.StartE("req4", nil, nil); err != ErrDraining {
+		t.Errorf("expected ErrDraining, got %v", err)
+	}
+	task := pl.StartTask(context.Background(), "req5", nil, nil)
+	if task.Context().Err() == nil {
+		t.Error("context not canceled for task started while draining")
+	}
+
+	w := httptest.NewRecorder()
+	pl.handleProcsReq(w, httptest.NewRequest("GET", "/procs/drain", nil))
+	var status DrainStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Draining || status.Running != 2 || status.Report == nil {
+		t.Errorf("bad drain status: %+v", status)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var pl Proclist
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pm/", pl.Handler("/debug/pm/"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(l)
+
+	c := newClient("http://" + l.Addr().String() + "/debug/pm")
+	checkProcResponse(t, c.getProcs(t), &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "req1", Status: "init"},
+		},
+	})
+	if err := c.makeRequest("GET", "/metrics", nil, nil); err != nil {
+		t.Error(err)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.makeRequest("GET", "/procs/", nil, nil); err == nil {
+		t.Error("server still running after Shutdown()")
+	}
+}
+
+// writeCert generates a certificate and key, signed by parent (self-signed if
+// nil), and writes them PEM-encoded into dir.
+func writeCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pm test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "pm test client"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var pl Proclist
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+	go pl.ListenAndServeTLS(addr, filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+
+	pool, err := LoadCertPool(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient("https://" + addr)
+	c.Transport = &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	}}
+	for i := 0; ; i++ {
+		err := c.makeRequest("GET", "/procs/", nil, nil)
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkProcResponse(t, c.getProcs(t), &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "req1", Status: "init"},
+		},
+	})
+
+	anon := newClient("https://" + addr)
+	anon.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	if err := anon.makeRequest("GET", "/procs/", nil, nil); err == nil {
+		t.Error("request without a client certificate was accepted")
+	}
+
+	if _, err := LoadCertPool(filepath.Join(dir, "client-key.pem")); err != ErrNoCertificates {
+		t.Errorf("unexpected error loading a key as CA bundle: %v", err)
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pm.sock")
+	var pl Proclist
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.ListenAndServeUnix(path, 0600); err == nil {
+		t.Fatal("ListenAndServeUnix() replaced a regular file")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A live socket is left alone, while a stale one is replaced
+	live, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.ListenAndServeUnix(path, 0600); err != ErrSocketInUse {
+		t.Fatalf("unexpected error for a socket in use: %v", err)
+	}
+	live.(*net.UnixListener).SetUnlinkOnClose(false)
+	live.Close()
+	go pl.ListenAndServeUnix(path, 0600)
+
+	c := newClient("http://unix")
+	c.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	for i := 0; ; i++ {
+		err := c.makeRequest("GET", "/procs/", nil, nil)
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkProcResponse(t, c.getProcs(t), &ProcResponse{
+		Procs: []ProcDetail{
+			ProcDetail{Id: "req1", Status: "init"},
+		},
+	})
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket mode: %v", fi.Mode())
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Errorf("unexpected files next to the socket: %v (%v)", entries, err)
+	}
+}
+
+func TestHandlerHMAC(t *testing.T) {
+	var pl Proclist
+	pl.Start("req1", nil, nil)
+	defer pl.Done("req1")
+	key := []byte("secret")
+	pl.SetAuthorizer(&HMACAuthorizer{Key: key, Perms: PermAll})
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pm/", pl.Handler("/debug/pm"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, sign := range []bool{true, false} {
+		req, err := http.NewRequest("GET", server.URL+"/debug/pm/procs/?sort=id", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sign {
+			if err := SignRequest(req, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if expected := map[bool]int{true: http.StatusOK, false: http.StatusUnauthorized}[sign]; resp.StatusCode != expected {
+			t.Errorf("signed=%v: got status %d; expecting %d", sign, resp.StatusCode, expected)
+		}
+	}
+}
+
 type Client struct {
 	*http.Client
 	BaseURI string
@@ -0,0 +1,88 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"time"
+)
+
+// progressState holds the progress reported for a process, protected by the
+// process' lock. The first report is kept as the baseline to compute rates.
+type progressState struct {
+	done, total int64
+	unit        string
+	first, last time.Time
+	firstDone   int64
+}
+
+// setProgress records the progress for the process, unless it has already
+// ended. Going backwards resets the baseline for rates.
+func (p *proc) setProgress(ts time.Time, done, total int64, unit string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.ended.IsZero() {
+		return
+	}
+	pr := &p.progress
+	if pr.last.IsZero() || done < pr.done {
+		pr.first, pr.firstDone = ts, done
+	}
+	pr.done, pr.total, pr.unit, pr.last = done, total, unit, ts
+}
+
+// progressDetail returns the progress for the process, or nil if none was
+// reported, assuming the lock is already held. The rate is averaged between the
+// first report and the latest one, and the estimated completion time assumes
+// it holds for the remaining work.
+func (p *proc) progressDetail() *ProgressDetail {
+	pr := &p.progress
+	if pr.last.IsZero() {
+		return nil
+	}
+	detail := &ProgressDetail{
+		Done:    pr.done,
+		Total:   pr.total,
+		Unit:    pr.unit,
+		Updated: pr.last,
+	}
+	if pr.total > 0 {
+		detail.Percent = 100 * float64(pr.done) / float64(pr.total)
+	}
+	if elapsed := pr.last.Sub(pr.first); elapsed > 0 && pr.done > pr.firstDone {
+		detail.Rate = float64(pr.done-pr.firstDone) / elapsed.Seconds()
+		if pr.total > pr.done && p.ended.IsZero() {
+			left := float64(pr.total-pr.done) / detail.Rate
+			eta := pr.last.Add(time.Duration(left * float64(time.Second)))
+			detail.ETA = &eta
+		}
+	}
+	return detail
+}
+
+// Progress records the progress for the task with the given identifier, as
+// the amount of work done out of a total (zero if unknown), measured in the
+// given unit (e.g., "rows" or "bytes"). Progress is reported to HTTP clients,
+// together with the rate and the estimated completion time. This is not a
+// cancellation point.
+func (pl *Proclist) Progress(id string, done, total int64, unit string) {
+	if p, present := pl.lookup(id); present {
+		p.setProgress(time.Now(), done, total, unit)
+	}
+}
+
+// Progress records the progress for the task, as the amount of work done out
+// of a total (zero if unknown), measured in the given unit. This is not a
+// cancellation point.
+func (t *Task) Progress(done, total int64, unit string) {
+	t.p.setProgress(time.Now(), done, total, unit)
+}
+
+// Progress records the progress for the task with the given identifier in the
+// default Proclist, as the amount of work done out of a total (zero if
+// unknown), measured in the given unit (e.g., "rows" or "bytes"). This is not
+// a cancellation point.
+func Progress(id string, done, total int64, unit string) {
+	DefaultProclist.Progress(id, done, total, unit)
+}
@@ -0,0 +1,268 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type ProcFilter selects tasks from a process list. All conditions set must
+// hold for a task to match; the zero value matches every task. Attribute values
+// are compared in their fmt.Sprint() representation.
+type ProcFilter struct {
+	Status     []string          `json:"status,omitempty"`     // Any of these statuses
+	Attrs      map[string]string `json:"attrs,omitempty"`      // Attributes equal to these values
+	AttrPrefix map[string]string `json:"attrPrefix,omitempty"` // Attributes starting with these values
+	MinAge     time.Duration     `json:"minAge,omitempty"`     // Tasks started at least this long ago
+	Cancelling *bool             `json:"cancelling,omitempty"` // Tasks with(out) a cancellation pending
+}
+
+// Type ProcQuery adds sorting and pagination to a ProcFilter. Sort is one of
+// "procTime", "statusTime", "id", "progress" (percent done) or "eta",
+// optionally prefixed with "-" to reverse the order. Tasks lacking progress (or
+// an estimated completion time) go first. A zero Limit means no limit.
+type ProcQuery struct {
+	ProcFilter
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+var ErrBadQuery = errors.New("bad query")
+
+// matches returns whether the task satisfies the filter.
+func (f *ProcFilter) matches(d *ProcDetail, now time.Time) bool {
+	if len(f.Status) > 0 {
+		found := false
+		for _, s := range f.Status {
+			if s == d.Status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, value := range f.Attrs {
+		v, present := d.Attrs[name]
+		if !present || fmt.Sprint(v) != value {
+			return false
+		}
+	}
+	for name, prefix := range f.AttrPrefix {
+		v, present := d.Attrs[name]
+		if !present || !strings.HasPrefix(fmt.Sprint(v), prefix) {
+			return false
+		}
+	}
+	if f.MinAge > 0 && now.Sub(d.ProcTime) < f.MinAge {
+		return false
+	}
+	if f.Cancelling != nil && *f.Cancelling != d.Cancelling {
+		return false
+	}
+	return true
+}
+
+// apply filters, sorts and paginates the list of tasks as per the query. It
+// returns the resulting list, together with the number of tasks that matched
+// the filter before pagination.
+func (q *ProcQuery) apply(procs []ProcDetail, now time.Time) ([]ProcDetail, int) {
+	matching := procs[:0]
+	for i := range procs {
+		if q.matches(&procs[i], now) {
+			matching = append(matching, procs[i])
+		}
+	}
+	total := len(matching)
+
+	field, desc := q.Sort, false
+	if strings.HasPrefix(field, "-") {
+		field, desc = field[1:], true
+	}
+	var less func(a, b *ProcDetail) bool
+	switch field {
+	case "procTime":
+		less = func(a, b *ProcDetail) bool { return a.ProcTime.Before(b.ProcTime) }
+	case "statusTime":
+		less = func(a, b *ProcDetail) bool { return a.StatusTime.Before(b.StatusTime) }
+	case "id":
+		less = func(a, b *ProcDetail) bool { return a.Id < b.Id }
+	case "progress":
+		less = func(a, b *ProcDetail) bool {
+			return b.Progress != nil && (a.Progress == nil || a.Progress.Percent < b.Progress.Percent)
+		}
+	case "eta":
+		less = func(a, b *ProcDetail) bool {
+			return b.Progress != nil && b.Progress.ETA != nil &&
+				(a.Progress == nil || a.Progress.ETA == nil || a.Progress.ETA.Before(*b.Progress.ETA))
+		}
+	}
+	if less != nil {
+		sort.SliceStable(matching, func(i, j int) bool {
+			if desc {
+				return less(&matching[j], &matching[i])
+			}
+			return less(&matching[i], &matching[j])
+		})
+	}
+
+	if q.Offset > 0 {
+		if q.Offset >= len(matching) {
+			return matching[:0], total
+		}
+		matching = matching[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(matching) {
+		matching = matching[:q.Limit]
+	}
+	return matching, total
+}
+
+// isZero returns whether the filter matches every task.
+func (f *ProcFilter) isZero() bool {
+	return len(f.Status) == 0 && len(f.Attrs) == 0 && len(f.AttrPrefix) == 0 &&
+		f.MinAge == 0 && f.Cancelling == nil
+}
+
+// KillMatching sets a cancellation request for every running task matching the
+// filter, as Kill() would do for each of them. (Note that a zero filter matches
+// all tasks.) The result lists the identifiers of the tasks marked for
+// cancellation, including descendants of those matching, and those refused
+// because of the ForbidCancel option. Tasks ending meanwhile are in neither.
+func (pl *Proclist) KillMatching(filter ProcFilter, message string) KillResponse {
+	ts := time.Now()
+	var matching []*proc
+	pl.mu.RLock()
+	for _, p := range pl.procs {
+		p.mu.RLock()
+		d := p.detail()
+		p.mu.RUnlock()
+		if filter.matches(&d, ts) {
+			matching = append(matching, p)
+		}
+	}
+	pl.mu.RUnlock()
+
+	killed := make(map[*proc]bool)
+	forbidden := make(map[*proc]bool)
+	for _, p := range matching {
+		marked, refused, _ := pl.killTree(p, ts, message)
+		for _, q := range marked {
+			killed[q] = true
+		}
+		for _, q := range refused {
+			forbidden[q] = true
+		}
+	}
+
+	result := KillResponse{Killed: []string{}, Forbidden: []string{}}
+	for p := range killed {
+		result.Killed = append(result.Killed, p.id)
+	}
+	for p := range forbidden {
+		result.Forbidden = append(result.Forbidden, p.id)
+	}
+	sort.Strings(result.Killed)
+	sort.Strings(result.Forbidden)
+	result.ServerTime = ts
+	return result
+}
+
+// KillMatching sets a cancellation request for every task in the default
+// Proclist matching the filter, as Kill() would do for each of them. (Note that
+// a zero filter matches all tasks.) The result lists the identifiers of the
+// tasks marked for cancellation, including descendants of those matching, and
+// those refused because of the ForbidCancel option. Tasks ending meanwhile are
+// in neither.
+func KillMatching(filter ProcFilter, message string) KillResponse {
+	return DefaultProclist.KillMatching(filter, message)
+}
+
+// Values encodes the query as URL parameters for a GET to /procs/.
+func (q *ProcQuery) Values() url.Values {
+	v := url.Values{}
+	for _, s := range q.Status {
+		v.Add("status", s)
+	}
+	for name, value := range q.Attrs {
+		v.Set("attr."+name, value)
+	}
+	for name, prefix := range q.AttrPrefix {
+		v.Set("attrPrefix."+name, prefix)
+	}
+	if q.MinAge > 0 {
+		v.Set("minAge", q.MinAge.String())
+	}
+	if q.Cancelling != nil {
+		v.Set("cancelling", strconv.FormatBool(*q.Cancelling))
+	}
+	if q.Sort != "" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Offset > 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	return v
+}
+
+// ParseProcQuery decodes a query from the URL parameters of a GET to /procs/.
+// Unknown parameters are ignored.
+func ParseProcQuery(v url.Values) (*ProcQuery, error) {
+	q := &ProcQuery{}
+	for key, values := range v {
+		if len(values) == 0 {
+			continue
+		}
+		value := values[len(values)-1]
+		var err error
+
+		switch {
+		case key == "status":
+			q.Status = values
+		case strings.HasPrefix(key, "attr."):
+			if q.Attrs == nil {
+				q.Attrs = make(map[string]string)
+			}
+			q.Attrs[key[len("attr."):]] = value
+		case strings.HasPrefix(key, "attrPrefix."):
+			if q.AttrPrefix == nil {
+				q.AttrPrefix = make(map[string]string)
+			}
+			q.AttrPrefix[key[len("attrPrefix."):]] = value
+		case key == "minAge":
+			q.MinAge, err = time.ParseDuration(value)
+		case key == "cancelling":
+			var cancelling bool
+			cancelling, err = strconv.ParseBool(value)
+			q.Cancelling = &cancelling
+		case key == "sort":
+			switch strings.TrimPrefix(value, "-") {
+			case "procTime", "statusTime", "id", "progress", "eta":
+				q.Sort = value
+			default:
+				err = ErrBadQuery
+			}
+		case key == "limit":
+			q.Limit, err = strconv.Atoi(value)
+		case key == "offset":
+			q.Offset, err = strconv.Atoi(value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s=%s", ErrBadQuery, key, value)
+		}
+	}
+	return q, nil
+}
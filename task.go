@@ -0,0 +1,138 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"context"
+	"time"
+)
+
+// Type Task is a handle for a running task, as returned by StartTask(). Its
+// methods work like the Proclist functions with the same names, but go
+// straight to the task instead of looking it up by identifier. Thus they are
+// cheaper, and they can't get mixed up with another task reusing the same id.
+type Task struct {
+	p   *proc
+	ctx context.Context
+}
+
+// StartTask works like StartContext(), but returns a handle for the task. The
+// context for the task is available through the handle. If id is empty, a
+// unique identifier is generated for the task. While the process list is being
+// drained, the task is not tracked and its context is canceled right away.
+func (pl *Proclist) StartTask(ctx context.Context, id string, opts *ProcOpts,
+	attrs *map[string]interface{}) *Task {
+
+	t, _ := pl.startTask(ctx, id, opts, attrs, false)
+	return t
+}
+
+// StartTaskE works like StartTask(), but fails with ErrDuplicateId if the
+// identifier is in use by a running task, instead of replacing it, or with
+// ErrDraining if the process list is being drained.
+func (pl *Proclist) StartTaskE(ctx context.Context, id string, opts *ProcOpts,
+	attrs *map[string]interface{}) (*Task, error) {
+
+	t, err := pl.startTask(ctx, id, opts, attrs, true)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (pl *Proclist) startTask(ctx context.Context, id string, opts *ProcOpts,
+	attrs *map[string]interface{}, unique bool) (*Task, error) {
+
+	p := pl.newProc(id, opts, attrs)
+	ctx, cancel := context.WithCancelCause(ctx)
+	p.cancelCtx = cancel
+	if err := pl.add(p, unique); err != nil {
+		// The task is left untracked, with its context canceled
+		cancel(err)
+		return &Task{p: p, ctx: ctx}, err
+	}
+	ctx = context.WithValue(ctx, taskKey{}, p)
+	return &Task{p: p, ctx: pl.setLabels(ctx, p)}, nil
+}
+
+// Id returns the identifier for the task.
+func (t *Task) Id() string {
+	return t.p.id
+}
+
+// Generation returns the generation number for the task, unique among all tasks
+// started in the process list.
+func (t *Task) Generation() uint64 {
+	return t.p.gen
+}
+
+// Context returns the context for the task, that is canceled as soon as a
+// cancellation request is received for the task, or when the task is Done().
+func (t *Task) Context() context.Context {
+	return t.ctx
+}
+
+// Status changes the status for the task, adding an item to its history. Note
+// that Status() is a cancellation point, thus the routine calling it is subject
+// to a panic due to a pending Kill(), unless the task's CancelMode is
+// CancelError.
+func (t *Task) Status(status string) {
+	t.p.cancelPoint(t.p.setStatus(time.Now(), status, false))
+}
+
+// StatusE works like Status(), but never panics. A pending cancellation is
+// returned as a CancelErr instead.
+func (t *Task) StatusE(status string) error {
+	return t.p.setStatus(time.Now(), status, true)
+}
+
+// CheckCancel introduces a cancellation point just like Status() does, but
+// without changing the task status, nor adding an entry to history.
+func (t *Task) CheckCancel() {
+	t.p.cancelPoint(t.p.checkCancel(false))
+}
+
+// CheckCancelE works like CheckCancel(), but never panics. A pending
+// cancellation is returned as a CancelErr instead.
+func (t *Task) CheckCancelE() error {
+	return t.p.checkCancel(true)
+}
+
+// SetAttribute sets an application-specific attribute for the task. Duplicate
+// attribute names overwrite the previously set value.
+func (t *Task) SetAttribute(name string, value interface{}) {
+	t.p.setAttribute(name, value)
+}
+
+// DelAttribute deletes an attribute for the task.
+func (t *Task) DelAttribute(name string) {
+	t.p.delAttribute(name)
+}
+
+// Done marks the end of the task, writing to history depending on the outcome
+// (i.e., aborted, killed or finished successfully). It also stops panics
+// raising from cancellation requests, but only when the StopCancelPanic option
+// is set AND Done is called with a defer statement. Other panics are stopped as
+// well if StopAbortPanic is set.
+func (t *Task) Done() {
+	t.p.pl.doneProc(t.p.id, t.p, recover())
+}
+
+// StartTask works like StartContext(), but returns a handle for the task. The
+// context for the task is available through the handle. If id is empty, a
+// unique identifier is generated for the task.
+func StartTask(ctx context.Context, id string, opts *ProcOpts,
+	attrs *map[string]interface{}) *Task {
+
+	return DefaultProclist.StartTask(ctx, id, opts, attrs)
+}
+
+// StartTaskE works like StartTask(), but fails with ErrDuplicateId if the
+// identifier is in use by a running task, instead of replacing it, or with
+// ErrDraining if the process list is being drained.
+func StartTaskE(ctx context.Context, id string, opts *ProcOpts,
+	attrs *map[string]interface{}) (*Task, error) {
+
+	return DefaultProclist.StartTaskE(ctx, id, opts, attrs)
+}
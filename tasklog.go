@@ -0,0 +1,177 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultLogMaxLines is the number of lines kept in task logs when the
+// LogMaxLines option is not set.
+const DefaultLogMaxLines = 1000
+
+// logBuffer holds the most recent log lines for a process, protected by the
+// process' lock. Followers wait on notify, that's closed as lines are added.
+type logBuffer struct {
+	lines  list.List
+	seq    uint64
+	notify chan struct{}
+}
+
+// logf adds a line to the log for the process, unless it has already ended,
+// dropping the oldest ones beyond the LogMaxLines option.
+func (p *proc) logf(format string, args ...interface{}) {
+	line := &LogLine{
+		Ts:   time.Now(),
+		Text: fmt.Sprintf(format, args...),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.ended.IsZero() {
+		return
+	}
+	p.logBuf.seq++
+	line.Seq = p.logBuf.seq
+	p.logBuf.lines.PushBack(line)
+
+	max := p.opts.LogMaxLines
+	if max <= 0 {
+		max = DefaultLogMaxLines
+	}
+	for p.logBuf.lines.Len() > max {
+		p.logBuf.lines.Remove(p.logBuf.lines.Front())
+	}
+	p.wakeLogFollowers()
+}
+
+// wakeLogFollowers notifies routines following the log, assuming the lock is
+// already held.
+func (p *proc) wakeLogFollowers() {
+	if p.logBuf.notify != nil {
+		close(p.logBuf.notify)
+		p.logBuf.notify = nil
+	}
+}
+
+// logSince returns the log lines with sequence numbers above seq, together
+// with a channel to be closed when further lines are added. The channel is nil
+// if the process has ended, so that no more lines are to be expected.
+func (p *proc) logSince(seq uint64) ([]LogLine, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines := make([]LogLine, 0, p.logBuf.lines.Len())
+	for entry := p.logBuf.lines.Front(); entry != nil; entry = entry.Next() {
+		if line := entry.Value.(*LogLine); line.Seq > seq {
+			lines = append(lines, *line)
+		}
+	}
+	if !p.ended.IsZero() {
+		return lines, nil
+	}
+	if p.logBuf.notify == nil {
+		p.logBuf.notify = make(chan struct{})
+	}
+	return lines, p.logBuf.notify
+}
+
+// Logf adds a line, formatted as with fmt.Sprintf(), to the log for the task
+// with the given identifier. Task logs are kept apart from history and bounded
+// by the LogMaxLines option, dropping the oldest lines. This is not a
+// cancellation point.
+func (pl *Proclist) Logf(id string, format string, args ...interface{}) {
+	if p, present := pl.lookup(id); present {
+		p.logf(format, args...)
+	}
+}
+
+// Logf adds a line, formatted as with fmt.Sprintf(), to the log for the task.
+// This is not a cancellation point.
+func (t *Task) Logf(format string, args ...interface{}) {
+	t.p.logf(format, args...)
+}
+
+func (pl *Proclist) handleLogReq(w http.ResponseWriter, r *http.Request, id string) {
+	pl.mu.RLock()
+	p, present := pl.procs[id]
+	pl.mu.RUnlock()
+
+	if !present {
+		if p, present = pl.findDone(id); !present {
+			httpError(w, http.StatusNotFound)
+			return
+		}
+	}
+
+	var follow bool
+	if v := r.URL.Query().Get("follow"); v != "" {
+		var err error
+		if follow, err = strconv.ParseBool(v); err != nil {
+			httpError(w, http.StatusBadRequest)
+			return
+		}
+	}
+	if !follow {
+		lines, _ := p.logSince(0)
+		b, err := json.Marshal(LogResponse{
+			Lines:      lines,
+			ServerTime: time.Now(),
+		})
+		if err != nil {
+			httpError(w, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(HeaderContentType, MediaJSON)
+		w.Write(b)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set(HeaderContentType, MediaEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var seq uint64
+	for {
+		lines, notify := p.logSince(seq)
+		for _, line := range lines {
+			b, err := json.Marshal(line)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: log\ndata: %s\n\n", b); err != nil {
+				return
+			}
+			seq = line.Seq
+		}
+		flusher.Flush()
+		if notify == nil {
+			return
+		}
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Logf adds a line, formatted as with fmt.Sprintf(), to the log for the task
+// with the given identifier in the default Proclist. Task logs are kept apart
+// from history and bounded by the LogMaxLines option, dropping the oldest
+// lines. This is not a cancellation point.
+func Logf(id string, format string, args ...interface{}) {
+	DefaultProclist.Logf(id, format, args...)
+}
@@ -0,0 +1,54 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+var ErrNoCertificates = errors.New("no certificates found")
+
+// ListenAndServeTLS starts an HTTPS server at the given address, using the
+// certificate and private key in the given files (PEM-encoded). If clientCAFile
+// is not empty, clients are required to present a certificate signed by one of
+// the authorities in that file (mutual TLS).
+func (pl *Proclist) ListenAndServeTLS(addr, certFile, keyFile, clientCAFile string) error {
+	server := pl.NewServer(addr)
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// LoadCertPool returns a pool with the certificates in the given file
+// (PEM-encoded), as required to verify peers in TLS connections.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrNoCertificates
+	}
+	return pool, nil
+}
+
+// ListenAndServeTLS starts an HTTPS server for the default Proclist at the given
+// address, using the certificate and private key in the given files
+// (PEM-encoded). If clientCAFile is not empty, clients are required to present a
+// certificate signed by one of the authorities in that file (mutual TLS).
+func ListenAndServeTLS(addr, certFile, keyFile, clientCAFile string) error {
+	return DefaultProclist.ListenAndServeTLS(addr, certFile, keyFile, clientCAFile)
+}
@@ -8,26 +8,76 @@ import (
 )
 
 // Type ProcDetail encodes a full process list from the server, including an
-// attributes array with application-defined names/values.
+// attributes array with application-defined names/values. Deadline and
+// Remaining are only set for tasks with a timeout; Remaining is negative if the
+// deadline has already expired.
 type ProcDetail struct {
 	Id         string                 `json:"id"`
+	Generation uint64                 `json:"gen,omitempty"`
+	ParentId   string                 `json:"parentId,omitempty"`
 	Attrs      map[string]interface{} `json:"attrs,omitempty"`
 	ProcTime   time.Time              `json:"procTime"`
 	StatusTime time.Time              `json:"statusTime"`
 	Status     string                 `json:"status"`
 	Cancelling bool                   `json:"cancelling,omitempty"`
+	Stalled    bool                   `json:"stalled,omitempty"`
+	Deadline   *time.Time             `json:"deadline,omitempty"`
+	Remaining  time.Duration          `json:"remaining,omitempty"`
+	Panic      *PanicDetail           `json:"panic,omitempty"`
+	Progress   *ProgressDetail        `json:"progress,omitempty"`
 }
 
-// ProcResponse is the response for a GET to /proc.
+// ProgressDetail encodes the progress reported by a task, as Done out of Total
+// (zero if unknown) in the given Unit, at time Updated. Rate is measured in
+// units per second, and ETA is the estimated completion time, if known.
+type ProgressDetail struct {
+	Done    int64      `json:"done"`
+	Total   int64      `json:"total,omitempty"`
+	Unit    string     `json:"unit,omitempty"`
+	Percent float64    `json:"percent,omitempty"`
+	Rate    float64    `json:"rate,omitempty"`
+	ETA     *time.Time `json:"eta,omitempty"`
+	Updated time.Time  `json:"updated"`
+}
+
+// ProcResponse is the response for a GET to /proc, as well as /proc/done and
+// /proc/<id>/children. Total is the number of tasks matching the query given to
+// /proc, before pagination.
 type ProcResponse struct {
 	Procs      []ProcDetail `json:"procs"`
+	Total      int          `json:"total,omitempty"`
+	Draining   bool         `json:"draining,omitempty"`
 	ServerTime time.Time    `json:"serverTime"`
 }
 
 // HistoryDetail encodes one entry from the process' history.
 type HistoryDetail struct {
-	Ts     time.Time `json:"ts"`
-	Status string    `json:"status"`
+	Ts     time.Time    `json:"ts"`
+	Status string       `json:"status"`
+	Panic  *PanicDetail `json:"panic,omitempty"`
+}
+
+// LogLine is a line from the log of a task. Seq numbers lines in the order
+// they were added, so that gaps show where old lines were dropped.
+type LogLine struct {
+	Seq  uint64    `json:"seq"`
+	Ts   time.Time `json:"ts"`
+	Text string    `json:"text"`
+}
+
+// LogResponse is the response for a GET to /procs/<id>/log.
+type LogResponse struct {
+	Lines      []LogLine `json:"lines"`
+	ServerTime time.Time `json:"serverTime"`
+}
+
+// PanicDetail describes the panic that aborted a task: the panic value (as
+// formatted by fmt.Sprint), the function and source line where it was raised,
+// and the stack trace of the goroutine at the time.
+type PanicDetail struct {
+	Value    string `json:"value"`
+	Location string `json:"location,omitempty"`
+	Stack    string `json:"stack,omitempty"`
 }
 
 // HistoryResponse is the response for a GET to /proc/<id>/history.
@@ -36,7 +86,90 @@ type HistoryResponse struct {
 	ServerTime time.Time       `json:"serverTime"`
 }
 
-// CancelRequest is the request body resulting from Kill().
+// CancelRequest is the request body resulting from Kill(). If Generation is
+// set, the request is refused unless it matches that of the running task.
 type CancelRequest struct {
-	Message string `json:"message"`
+	Message    string `json:"message"`
+	Generation uint64 `json:"gen,omitempty"`
+}
+
+// KillRequest is the request body for a POST to /procs/kill, setting a
+// cancellation request for all tasks matching the filter.
+type KillRequest struct {
+	Filter  ProcFilter `json:"filter"`
+	Message string     `json:"message"`
+}
+
+// KillResponse is the response for a POST to /procs/kill, listing the tasks
+// marked for cancellation (descendants of those matching included) and those
+// where cancellation is forbidden.
+type KillResponse struct {
+	Killed     []string  `json:"killed"`
+	Forbidden  []string  `json:"forbidden"`
+	ServerTime time.Time `json:"serverTime"`
+}
+
+// DrainRequest is the request body for a POST to /procs/drain. Tasks still
+// running after the grace period get a cancellation request. Grace is given in
+// nanoseconds (as with time.Duration) and must be positive.
+type DrainRequest struct {
+	Grace time.Duration `json:"grace"`
+}
+
+// DrainReport is the result of draining a process list.
+type DrainReport struct {
+	Ended     []string `json:"ended"`
+	Killed    []string `json:"killed"`
+	Forbidden []string `json:"forbidden"`
+}
+
+// DrainStatus is the response for a GET to /procs/drain. The report is only
+// available after draining completes.
+type DrainStatus struct {
+	Draining   bool         `json:"draining"`
+	Running    int          `json:"running"`
+	Report     *DrainReport `json:"report,omitempty"`
+	ServerTime time.Time    `json:"serverTime"`
+}
+
+// Type EventType identifies the kind of lifecycle change reported by an Event.
+type EventType string
+
+const (
+	EventStart         EventType = "start"
+	EventStatus        EventType = "status"
+	EventAttribute     EventType = "attribute"
+	EventCancelRequest EventType = "cancel"
+	EventDone          EventType = "done"
+	EventCancelDenied  EventType = "cancel-denied"
+	EventStalled       EventType = "stalled"
+)
+
+// Event encodes a change in the lifecycle of a task, as sent through the
+// /procs/events stream and to Proclist subscribers. Status holds the history
+// entry added by the change, if any. Attrs holds the full set of attributes for
+// start events, or the single attribute changed otherwise (with a nil value if
+// the attribute was deleted). Outcome is set for done events only, to one of
+// "ended", "killed" or "aborted", with Panic set for the latter.
+type Event struct {
+	Type       EventType              `json:"type"`
+	Id         string                 `json:"id"`
+	Generation uint64                 `json:"gen,omitempty"`
+	ParentId   string                 `json:"parentId,omitempty"`
+	Ts         time.Time              `json:"ts"`
+	Status     string                 `json:"status,omitempty"`
+	Attrs      map[string]interface{} `json:"attrs,omitempty"`
+	Outcome    string                 `json:"outcome,omitempty"`
+	Panic      *PanicDetail           `json:"panic,omitempty"`
+}
+
+// JournalTask is a task as reconstructed from a journal by ReadJournal(). An
+// empty Outcome means that the task never ended.
+type JournalTask struct {
+	Id         string                 `json:"id"`
+	Generation uint64                 `json:"gen,omitempty"`
+	ParentId   string                 `json:"parentId,omitempty"`
+	Attrs      map[string]interface{} `json:"attrs"`
+	History    []HistoryDetail        `json:"history"`
+	Outcome    string                 `json:"outcome,omitempty"`
 }
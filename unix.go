@@ -0,0 +1,65 @@
+package pm
+
+// Copyright (c) 2013 VividCortex, Inc. All rights reserved.
+// Please see the LICENSE file for applicable license terms.
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+var ErrSocketInUse = errors.New("socket in use by another process")
+
+// ListenAndServeUnix starts an HTTP server listening on a Unix domain socket at
+// the given path, with its file permissions set to mode. Filesystem permissions
+// thus control who can reach the interface. A stale socket at path (e.g., left
+// by a previous run) is removed first, but ErrSocketInUse is returned if some
+// process is still listening on it; any other kind of file is an error. The
+// socket is created within a private directory and only linked at path once
+// its permissions are set, so that it's never reachable with looser ones.
+func (pl *Proclist) ListenAndServeUnix(path string, mode os.FileMode) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return ErrSocketInUse
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".pm-")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", tmp)
+	if err == nil {
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		if err = os.Chmod(tmp, mode); err == nil {
+			err = os.Link(tmp, path)
+		}
+		if err != nil {
+			l.Close()
+		}
+	}
+	os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	return pl.Serve(l)
+}
+
+// ListenAndServeUnix starts an HTTP server for the default Proclist, listening
+// on a Unix domain socket at the given path, with its file permissions set to
+// mode. A stale socket at path is removed first, unless still in use.
+func ListenAndServeUnix(path string, mode os.FileMode) error {
+	return DefaultProclist.ListenAndServeUnix(path, mode)
+}